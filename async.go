@@ -0,0 +1,151 @@
+package sej
+
+// maxAsyncBatch is the maximal number of queued messages appended at once
+const maxAsyncBatch = 1024
+
+// AppendResult is the future of a message appended by Writer.AppendAsync
+type AppendResult struct {
+	msg  *Message
+	err  error
+	done chan struct{}
+}
+
+// Done returns a channel that is closed when the message is durable according
+// to the durability policy of the writer, i.e. flushed with SyncNone and synced
+// otherwise, or when the append fails
+func (r *AppendResult) Done() <-chan struct{} {
+	return r.done
+}
+
+// Offset returns the offset assigned to the message, only valid after Done is closed
+func (r *AppendResult) Offset() uint64 {
+	return r.msg.Offset
+}
+
+// Err returns the error of the append, only valid after Done is closed
+func (r *AppendResult) Err() error {
+	return r.err
+}
+
+// Wait blocks until Done is closed and returns Err
+func (r *AppendResult) Wait() error {
+	<-r.done
+	return r.err
+}
+
+func (r *AppendResult) complete(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// AppendAsync queues a message to be appended by a background goroutine and
+// returns without waiting for the writer lock or any I/O. The message must not
+// be modified until the result is done.
+func (w *Writer) AppendAsync(msg *Message) *AppendResult {
+	r := &AppendResult{msg: msg, done: make(chan struct{})}
+	if err := checkMessage(msg); err != nil {
+		r.complete(err)
+		return r
+	}
+	w.asyncMu.Lock()
+	defer w.asyncMu.Unlock()
+	if w.asyncClosed {
+		r.complete(ErrWriterClosed)
+		return r
+	}
+	if w.queue == nil {
+		w.startAsync()
+	}
+	w.queue <- r
+	return r
+}
+
+// startAsync starts the goroutines appending the queued messages and
+// completing the results of the appended messages
+func (w *Writer) startAsync() {
+	queue := make(chan *AppendResult, maxAsyncBatch)
+	appended := make(chan []*AppendResult, maxAsyncBatch)
+	drained := make(chan struct{})
+	done := make(chan struct{})
+	w.queue, w.asyncDrained, w.asyncDone = queue, drained, done
+	go func() {
+		defer close(drained)
+		w.appendQueued(queue, appended)
+	}()
+	go func() {
+		defer close(done)
+		w.completeAppended(appended)
+	}()
+}
+
+// appendQueued appends the queued messages in batches until the queue is closed
+func (w *Writer) appendQueued(queue <-chan *AppendResult, appended chan<- []*AppendResult) {
+	defer close(appended)
+	var msgs []Message
+	for r := range queue {
+		batch := []*AppendResult{r}
+	drain:
+		for len(batch) < maxAsyncBatch {
+			select {
+			case r, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+		msgs = msgs[:0]
+		for _, r := range batch {
+			msgs = append(msgs, *r.msg)
+		}
+		_, err := w.appendBatch(msgs)
+		if err == nil && w.opts.Durability.Mode == SyncNone {
+			err = w.Flush()
+		}
+		for i, r := range batch {
+			r.msg.Offset = msgs[i].Offset
+		}
+		if err != nil || w.opts.Durability.Mode == SyncNone {
+			for _, r := range batch {
+				r.complete(err)
+			}
+			continue
+		}
+		appended <- batch
+	}
+}
+
+// completeAppended completes the results of the appended messages once they
+// are synced
+func (w *Writer) completeAppended(appended <-chan []*AppendResult) {
+	for batch := range appended {
+		offset := batch[len(batch)-1].msg.Offset + 1
+		var err error
+		if w.opts.Durability.Mode == SyncGroupCommit {
+			err = w.waitDurable(offset)
+		} else {
+			err = w.commit.waitSynced(offset)
+		}
+		for _, r := range batch {
+			r.complete(err)
+		}
+	}
+}
+
+// stopAsync stops accepting new messages and waits until the queued ones are
+// appended, it returns a channel closed when all the results are completed
+func (w *Writer) stopAsync() <-chan struct{} {
+	w.asyncMu.Lock()
+	w.asyncClosed = true
+	queue, drained, done := w.queue, w.asyncDrained, w.asyncDone
+	w.queue = nil
+	w.asyncMu.Unlock()
+	if queue == nil {
+		return nil
+	}
+	close(queue)
+	<-drained
+	return done
+}
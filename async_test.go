@@ -0,0 +1,46 @@
+package sej
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAppendAsync(t *testing.T) {
+	for _, mode := range []DurabilityMode{SyncNone, SyncGroupCommit} {
+		path := newTestPath(t)
+		w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: mode}})
+
+		var values []string
+		var results []*AppendResult
+		for i := 0; i < 100; i++ {
+			values = append(values, strconv.Itoa(i))
+			results = append(results, w.AppendAsync(&Message{Value: []byte(values[i])}))
+		}
+		for i, r := range results {
+			if err := r.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			if r.Offset() != uint64(i) {
+				t.Fatalf("mode %d: expect offset %d but got %d", mode, i, r.Offset())
+			}
+		}
+		// the messages are visible without closing the writer
+		Test{t}.VerifyMessageValues(path, values...)
+		closeTestWriter(t, w)
+	}
+}
+
+func TestAppendAsyncClose(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: SyncBytes, Bytes: 1 << 20}})
+
+	r := w.AppendAsync(&Message{Value: []byte("a")})
+	closeTestWriter(t, w)
+	if err := r.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendAsync(&Message{Value: []byte("b")}).Wait(); err != ErrWriterClosed {
+		t.Fatalf("expect ErrWriterClosed but got %v", err)
+	}
+	Test{t}.VerifyMessageValues(path, "a")
+}
@@ -0,0 +1,399 @@
+package sej
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression codec of the message batches written by a Writer
+type Codec byte
+
+const (
+	// CodecNone writes each message on its own without compression
+	CodecNone Codec = iota
+	// CodecSnappy compresses each batch with Snappy
+	CodecSnappy
+	// CodecZstd compresses each batch with Zstandard
+	CodecZstd
+)
+
+const (
+	// formatBatchV1 is the format of a batch record holding compressed messages
+	// instead of a message, the messages are encoded in their own formats
+	formatBatchV1 = 0x40
+	// formatBatch adds the count of the messages after the codec, so that a
+	// batch can be read as a record without being decrypted or decompressed
+	formatBatch = 0x41
+	// codecEncrypted is set in the codec byte of a batch whose value is encrypted
+	codecEncrypted = 0x80
+)
+
+// the encoder and decoder are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (c Codec) encode(dst, src []byte) []byte {
+	switch c {
+	case CodecSnappy:
+		return snappy.Encode(dst[:cap(dst)], src)
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(src, dst[:0])
+	}
+	return append(dst[:0], src...)
+}
+
+func (c Codec) decode(dst, src []byte) ([]byte, error) {
+	switch c {
+	case CodecSnappy:
+		return snappy.Decode(dst[:cap(dst)], src)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(src, dst[:0])
+	case CodecNone:
+		// only an encrypted batch is not compressed
+		return append(dst[:0], src...), nil
+	}
+	return nil, errMessageCorrupted
+}
+
+// batchWriter collects the encoded messages to be compressed into a batch
+type batchWriter struct {
+	buf        bytes.Buffer
+	compressed []byte
+	sealed     []byte
+	offset     uint64    // the offset of the first message
+	timestamp  time.Time // the maximal timestamp of the messages
+	count      int
+}
+
+func (b *batchWriter) add(msg *Message, buf []byte) error {
+	if b.count == 0 {
+		b.offset = msg.Offset
+		b.timestamp = msg.Timestamp
+	} else if msg.Timestamp.After(b.timestamp) {
+		b.timestamp = msg.Timestamp
+	}
+	if _, err := WriteMessage(&b.buf, buf, msg); err != nil {
+		return err
+	}
+	b.count++
+	return nil
+}
+
+// writeTo compresses the messages with codec, encrypts them with aead if it is
+// not nil, and writes them as a batch record to w, then empties the batch
+func (b *batchWriter) writeTo(w io.Writer, buf []byte, codec Codec, aead cipher.AEAD) (int64, error) {
+	count := uint32(b.count)
+	b.compressed = codec.encode(b.compressed, b.buf.Bytes())
+	b.buf.Reset()
+	b.count = 0
+	value := b.compressed
+	if aead != nil {
+		codec |= codecEncrypted
+		var err error
+		b.sealed, err = seal(aead, b.sealed, b.compressed, batchAAD(b.offset, b.timestamp, codec, count))
+		if err != nil {
+			return 0, err
+		}
+		value = b.sealed
+	}
+
+	cnt := int64(0)
+	cw := crcWriter{w: w}
+	n, err := writeUint64(&cw, buf, b.offset)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = writeInt64(&cw, buf, unixNano(b.timestamp))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	// type is unused, followed by format and codec
+	n, err = cw.Write([]byte{0, formatFlag | formatBatch, byte(codec)})
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = writeUint32(&cw, count)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = writeInt32(&cw, buf, int32(len(value)))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = cw.Write(value)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = writeUint32(w, cw.crc)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	n, err = writeInt32(w, buf, int32(cnt)+4)
+	cnt += int64(n)
+	return cnt, err
+}
+
+// batchAAD returns the additional data authenticated with an encrypted batch,
+// so that its messages cannot be moved to another offset or time
+func batchAAD(offset uint64, timestamp time.Time, codec Codec, count uint32) []byte {
+	aad := make([]byte, 8+8+1+4)
+	binary.BigEndian.PutUint64(aad, offset)
+	binary.BigEndian.PutUint64(aad[8:], uint64(unixNano(timestamp)))
+	aad[16] = byte(codec)
+	binary.BigEndian.PutUint32(aad[17:], count)
+	return aad
+}
+
+// batchReader holds the decompressed messages of the batch being read
+type batchReader struct {
+	data       []byte
+	pos        int       // the position of the next message
+	last       int       // the position of the last message read, -1 if it is not in the batch
+	compressed []byte    // reused unless it aliases a memory-mapped file
+	plain      []byte    // the decrypted value
+	cr         crcReader // reads the messages from the batchReader itself
+}
+
+// readBatch reads the rest of a batch record in format, with cnt bytes of the
+// record and the offset and timestamp of m read, and decrypts and decompresses
+// its messages to be read from r.batch unless r.records is true. A batch in
+// formatBatchV1 is always decompressed for the count of its messages.
+// It returns the bytes of the record read in total.
+func (r *crcReader) readBatch(cnt int64, m *Message, format byte) (int64, error) {
+	b, nn, err := r.next(1, true)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	codec := Codec(b[0])
+	count := uint32(0)
+	if format == formatBatch {
+		b, nn, err = r.next(4, true)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		if count = binary.BigEndian.Uint32(b); count == 0 {
+			return cnt, errMessageCorrupted
+		}
+	} else if codec&codecEncrypted != 0 {
+		// encrypted batches always have the count
+		return cnt, errMessageCorrupted
+	}
+	b, nn, err = r.next(4, true)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	size := int32(binary.BigEndian.Uint32(b))
+	if size < 0 {
+		return cnt, errMessageCorrupted
+	}
+	if r.batch == nil {
+		r.batch = &batchReader{last: -1}
+		r.batch.cr.r = r.batch
+	}
+	batch := r.batch
+	compressed, nn, err := r.readBytes(batch.compressed, int(size), true)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	if nn != int(size) {
+		return cnt, fmt.Errorf("batch is truncated at %d", cnt)
+	}
+	if !r.aliasing() {
+		batch.compressed = compressed
+	}
+	crc := r.crc
+
+	b, nn, err = r.next(4, false)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	storedCRC := binary.BigEndian.Uint32(b)
+	b, nn, err = r.next(4, false)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	if size := int32(binary.BigEndian.Uint32(b)); int64(size) != cnt {
+		return cnt, errMessageCorrupted
+	}
+	if storedCRC != crc {
+		return cnt, ErrCRC
+	}
+	r.count = int(count)
+	if r.records && count > 0 {
+		return cnt, nil
+	}
+
+	if codec&codecEncrypted != 0 {
+		if r.aead == nil {
+			return cnt, ErrNoKey
+		}
+		batch.plain, err = open(r.aead, batch.plain, compressed, batchAAD(m.Offset, m.Timestamp, codec, count))
+		if err != nil {
+			return cnt, err
+		}
+		compressed = batch.plain
+		codec &^= codecEncrypted
+	}
+	data, err := codec.decode(batch.data, compressed)
+	if err != nil {
+		return cnt, errMessageCorrupted
+	}
+	batch.data, batch.pos, batch.last = data, 0, -1
+	if count == 0 {
+		if r.count, err = batch.countMessages(); err != nil {
+			return cnt, err
+		}
+		if r.records {
+			batch.reset()
+		}
+	}
+	return cnt, nil
+}
+
+// countMessages returns the number of the messages in the batch without
+// moving the position
+func (b *batchReader) countMessages() (int, error) {
+	var m Message
+	pos, count := b.pos, 0
+	for b.pos < len(b.data) {
+		if _, err := m.readFrom(&b.cr, true, nil); err != nil {
+			b.reset()
+			return 0, errMessageCorrupted
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, errMessageCorrupted
+	}
+	b.pos = pos
+	return count, nil
+}
+
+// readRecord reads the next message or batch as a record into m, without
+// decrypting or decompressing a batch, so that m has only the offset of its
+// first message and its maximal timestamp. It returns the bytes read and the
+// offset of the last message in the record.
+func (r *crcReader) readRecord(m *Message) (int64, uint64, error) {
+	r.records = true
+	n, err := m.readFrom(r, false, nil)
+	return n, m.Offset + uint64(r.count) - 1, err
+}
+
+// aliasing returns true if the bytes read alias the underlying reader
+func (r *crcReader) aliasing() bool {
+	_, ok := r.r.(aliasReader)
+	return ok
+}
+
+// inBatch returns true if the last message read is in a batch
+func (r *crcReader) inBatch() bool {
+	return r.batch != nil && r.batch.last >= 0
+}
+
+// resetBatch drops the rest of the batch being read if any
+func (r *crcReader) resetBatch() {
+	if r.batch != nil {
+		r.batch.reset()
+	}
+}
+
+// unreadBatch moves back to the last message read if it is in a batch
+func (r *crcReader) unreadBatch() {
+	if r.inBatch() {
+		r.batch.pos, r.batch.last = r.batch.last, -1
+	}
+}
+
+// readMessage reads the next message of the batch like Message.readFrom
+func (b *batchReader) readMessage(m *Message, reuse bool, filter func(*Message) bool) error {
+	b.last = b.pos
+	_, err := m.readFrom(&b.cr, reuse, filter)
+	switch err {
+	case nil, errMessageSkipped:
+		return err
+	case io.EOF, io.ErrUnexpectedEOF:
+		// the batch has been verified, so it cannot be incomplete
+		err = errMessageCorrupted
+	}
+	b.reset()
+	return err
+}
+
+func (b *batchReader) reset() {
+	b.data, b.pos, b.last = b.data[:0], 0, -1
+}
+
+// Len returns the number of the unread bytes
+func (b *batchReader) Len() int {
+	return len(b.data) - b.pos
+}
+
+func (b *batchReader) Read(p []byte) (int, error) {
+	if b.pos >= len(b.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.pos:])
+	b.pos += n
+	return n, nil
+}
+
+func (b *batchReader) skip(n int) (int, error) {
+	if rest := len(b.data) - b.pos; n > rest {
+		b.pos = len(b.data)
+		return rest, io.ErrUnexpectedEOF
+	}
+	b.pos += n
+	return n, nil
+}
+
+// MessageReader reads messages one by one like Message.ReadFrom, including
+// all the messages of compressed batches
+type MessageReader struct {
+	r crcReader
+}
+
+// NewMessageReader creates a MessageReader reading from r
+func NewMessageReader(r io.Reader) *MessageReader {
+	return &MessageReader{r: crcReader{r: r}}
+}
+
+// SetKey makes the reader decrypt the messages of the segment file with the
+// header with a key from keys, the messages of an encrypted segment file
+// cannot be read without it
+func (r *MessageReader) SetKey(header *SegmentHeader, keys KeyProvider) error {
+	aead, err := segmentAEAD(header, keys)
+	if err != nil {
+		return err
+	}
+	r.r.aead = aead
+	return nil
+}
+
+// ReadMessage reads the next message into m and returns the number of bytes
+// read from the underlying reader, which is 0 for the messages of a batch
+// after the first one, because the whole batch is read with the first one
+func (r *MessageReader) ReadMessage(m *Message) (int64, error) {
+	return m.readFrom(&r.r, false, nil)
+}
@@ -0,0 +1,258 @@
+package sej
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBatchScan(t *testing.T) {
+	for _, codec := range []Codec{CodecSnappy, CodecZstd} {
+		path := newTestPath(t)
+		w := newTestWriterOptions(t, path, WriterOptions{
+			SegmentSize:   1000,
+			IndexInterval: 1,
+			Codec:         codec,
+			BatchSize:     3 * (metaSize + 100),
+		})
+		for i := 0; i < 50; i++ {
+			msg := Message{
+				Key:     []byte(strconv.Itoa(i)),
+				Headers: []Header{{Name: "h", Value: []byte{byte(i)}}},
+				Value:   bytes.Repeat([]byte(strconv.Itoa(i%10)), 100),
+			}
+			if err := w.Append(&msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeTestWriter(t, w)
+
+		for _, zeroCopy := range []bool{false, true} {
+			for _, start := range []uint64{0, 1, 2, 3, 25, 49} {
+				s := newTestScanner(t, path, start, ScannerOptions{ZeroCopy: zeroCopy, StopAtTail: true})
+				for i := start; s.Scan(); i++ {
+					msg := s.Message()
+					if msg.Offset != i || string(msg.Key) != strconv.Itoa(int(i)) ||
+						msg.Headers[0].Value[0] != byte(i) || msg.Value[99] != strconv.Itoa(int(i%10))[0] {
+						t.Fatalf("codec %d: unexpected message %d at %d", codec, msg.Offset, i)
+					}
+				}
+				if s.Err() != io.EOF || s.Offset() != 50 {
+					t.Fatalf("codec %d: expect EOF at 50 but got %v at %d", codec, s.Err(), s.Offset())
+				}
+				s.Close()
+			}
+		}
+
+		s := newTestScanner(t, path, 0, ScannerOptions{
+			StopAtTail: true,
+			EndOffset:  40,
+			Filter:     func(msg *Message) bool { return msg.Offset%7 == 0 },
+		})
+		values := ""
+		for s.Scan() {
+			values += string(s.Message().Value[:1])
+		}
+		if s.Err() != io.EOF || values != "074185" || s.Offset() != 40 {
+			t.Fatalf("codec %d: expect 074185 at 40 but got %s at %d, %v", codec, values, s.Offset(), s.Err())
+		}
+		s.Close()
+	}
+}
+
+func TestBatchReverseScan(t *testing.T) {
+	path := newTestPath(t)
+	// 3 messages per batch and segment
+	w := newTestWriterOptions(t, path, WriterOptions{
+		SegmentSize:   headerSize + 2,
+		IndexInterval: 1,
+		Codec:         CodecSnappy,
+		BatchSize:     3 * (metaSize + 1),
+	})
+	for i := 0; i < 10; i++ {
+		writeTestMessages(t, w, strconv.Itoa(i))
+	}
+	closeTestWriter(t, w)
+
+	for _, testcase := range []struct {
+		offset   uint64
+		expected string
+	}{
+		{offset: math.MaxUint64, expected: "9876543210"},
+		{offset: 8, expected: "76543210"},
+		{offset: 6, expected: "543210"},
+		{offset: 5, expected: "43210"},
+		{offset: 1, expected: "0"},
+		{offset: 0, expected: ""},
+	} {
+		r, err := NewReverseScanner(path, testcase.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := ""
+		for r.Scan() {
+			values += string(r.Message().Value)
+			if r.Offset() != r.Message().Offset {
+				t.Fatalf("expect offset %d but got %d", r.Message().Offset, r.Offset())
+			}
+		}
+		if r.Err() != nil {
+			t.Fatal(r.Err())
+		}
+		r.Close()
+		if values != testcase.expected {
+			t.Fatalf("offset %d: expect %s but got %s", testcase.offset, testcase.expected, values)
+		}
+	}
+}
+
+func TestBatchSeekTime(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{
+		IndexInterval: 1,
+		Codec:         CodecZstd,
+		BatchSize:     2 * (metaSize + 1),
+	})
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	secs := []int{1, 2, 4, 3, 6, 5, 7, 9, 8}
+	for _, sec := range secs {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(sec) * time.Second), Value: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: time.Millisecond})
+	defer s.Close()
+	for _, testcase := range []struct {
+		sec    int
+		offset uint64
+	}{
+		{sec: 0, offset: 0},
+		{sec: 3, offset: 2},
+		{sec: 5, offset: 4},
+		{sec: 7, offset: 6},
+		{sec: 8, offset: 7},
+		{sec: 10, offset: 9},
+	} {
+		if err := s.SeekTime(base.Add(time.Duration(testcase.sec) * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if s.Offset() != testcase.offset {
+			t.Fatalf("%ds: expect offset %d but got %d", testcase.sec, testcase.offset, s.Offset())
+		}
+	}
+}
+
+func TestBatchReopen(t *testing.T) {
+	path := newTestPath(t)
+	opts := WriterOptions{Codec: CodecSnappy, BatchSize: 2 * (metaSize + 1)}
+	w := newTestWriterOptions(t, path, opts)
+	writeTestMessages(t, w, "a", "b", "c", "d", "e")
+	closeTestWriter(t, w)
+
+	w = newTestWriterOptions(t, path, opts)
+	if w.Offset() != 5 {
+		t.Fatalf("expect offset 5 but got %d", w.Offset())
+	}
+	writeTestMessages(t, w, "f")
+	closeTestWriter(t, w)
+	Test{t}.VerifyMessageValues(path, "a", "b", "c", "d", "e", "f")
+
+	// corrupt the last batch with "f"
+	truncateFile(t, JournalDirPath(path)+"/0000000000000000.jnl", 1)
+	opts.WriterID = testWriterID
+	if _, err := NewWriterOptions(path, opts); err == nil {
+		t.Fatal("expect corruption error but got nil")
+	} else if e, ok := err.(*CorruptionError); !ok || e.Offset != 5 {
+		t.Fatalf("expect corruption at 5 but got %v", err)
+	}
+	w = newTestWriterOptions(t, path, opts)
+	defer closeTestWriter(t, w)
+	if w.Offset() != 5 {
+		t.Fatalf("expect offset 5 but got %d", w.Offset())
+	}
+}
+
+func TestBatchLinger(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Codec: CodecZstd, BatchLinger: time.Millisecond})
+	defer closeTestWriter(t, w)
+	writeTestMessages(t, w, "a")
+
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: time.Second})
+	defer s.Close()
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if value := string(s.Message().Value); value != "a" {
+		t.Fatalf("expect a but got %s", value)
+	}
+}
+
+func TestBatchCompressed(t *testing.T) {
+	sizes := make(map[Codec]int)
+	for _, codec := range []Codec{CodecNone, CodecSnappy, CodecZstd} {
+		path := newTestPath(t)
+		w := newTestWriterOptions(t, path, WriterOptions{Codec: codec})
+		for i := 0; i < 100; i++ {
+			value := []byte(`{"id":` + strconv.Itoa(i) + `,"name":"sej","tags":["a","b","c"]}`)
+			if err := w.Append(&Message{Value: value}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeTestWriter(t, w)
+		dir, err := OpenJournalDir(JournalDirPath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[codec] = dir.Files[0].size(t)
+	}
+	for _, codec := range []Codec{CodecSnappy, CodecZstd} {
+		if sizes[codec]*2 > sizes[CodecNone] {
+			t.Fatalf("codec %d: expect less than half of %d bytes but got %d", codec, sizes[CodecNone], sizes[codec])
+		}
+	}
+}
+
+func TestBatchFormatV1(t *testing.T) {
+	path := newTestPath(t)
+	if err := os.MkdirAll(JournalDirPath(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a batch without count written before encryption was introduced
+	buf := make([]byte, 8)
+	var messages bytes.Buffer
+	for i, value := range []string{"a", "b", "c"} {
+		if _, err := WriteMessage(&messages, buf, &Message{Offset: uint64(i), Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compressed := CodecSnappy.encode(nil, messages.Bytes())
+	var record bytes.Buffer
+	cw := crcWriter{w: &record}
+	writeUint64(&cw, buf, 0)
+	writeInt64(&cw, buf, unixNano(time.Time{}))
+	cw.Write([]byte{0, formatFlag | formatBatchV1, byte(CodecSnappy)})
+	writeInt32(&cw, buf, int32(len(compressed)))
+	cw.Write(compressed)
+	writeUint32(&record, cw.crc)
+	writeInt32(&record, buf, int32(record.Len())+4)
+	if err := ioutil.WriteFile(journalFileName(JournalDirPath(path), 0), record.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jf := JournalFile{FileName: journalFileName(JournalDirPath(path), 0)}
+	if offset, err := jf.LastOffset(); err != nil || offset != 3 {
+		t.Fatalf("expect last offset 3 but got %d, %v", offset, err)
+	}
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "d")
+	closeTestWriter(t, w)
+	Test{t}.VerifyMessageValues(path, "a", "b", "c", "d")
+}
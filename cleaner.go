@@ -0,0 +1,168 @@
+package sej
+
+import (
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cleaner deletes the oldest segment files of a journal directory according to
+// the retention rules. A segment file is deleted only if any of the rules
+// matches and all the readers with offsets persisted in dir/ofs have read
+// beyond it. The active (last) segment file is never deleted.
+type Cleaner struct {
+	dir  string
+	stop chan struct{}
+	done chan struct{}
+	mu   sync.Mutex
+
+	MaxAge      time.Duration // delete segments whose newest message is older than MaxAge, 0 means no limit
+	MaxBytes    int64         // delete segments until the total size is within MaxBytes, 0 means no limit
+	MaxSegments int           // delete segments until the number of segments is within MaxSegments, 0 means no limit
+
+	// OnClean is called with the result of each cleaning run started by Start
+	OnClean func(removed []string, err error)
+}
+
+// NewCleaner creates a cleaner for the journal directory dir
+func NewCleaner(dir string) *Cleaner {
+	return &Cleaner{dir: dir}
+}
+
+// Clean deletes the segment files that should not be retained together with
+// their index and meta files, and returns the names of the deleted segment files
+func (c *Cleaner) Clean() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, err := openFileLock(maintenanceLockName(c.dir))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	dir, err := OpenJournalDir(JournalDirPath(c.dir))
+	if err != nil {
+		return nil, err
+	}
+	slowestOffset, err := slowestReaderOffset(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(dir.Files))
+	var totalSize int64
+	for i := range dir.Files {
+		stat, err := os.Stat(dir.Files[i].FileName)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = stat.Size()
+		totalSize += sizes[i]
+	}
+
+	var removed []string
+	now := time.Now()
+	for i := 0; i < len(dir.Files)-1; i++ {
+		journalFile, next := &dir.Files[i], &dir.Files[i+1]
+		if slowestOffset < next.FirstOffset {
+			break
+		}
+		expired, err := c.expired(journalFile, now)
+		if err != nil {
+			return removed, err
+		}
+		if !expired &&
+			!(c.MaxBytes > 0 && totalSize > c.MaxBytes) &&
+			!(c.MaxSegments > 0 && len(dir.Files)-i > c.MaxSegments) {
+			break
+		}
+		if err := removeSegment(journalFile.FileName); err != nil {
+			return removed, err
+		}
+		totalSize -= sizes[i]
+		removed = append(removed, journalFile.FileName)
+	}
+	return removed, nil
+}
+
+func (c *Cleaner) expired(journalFile *JournalFile, now time.Time) (bool, error) {
+	if c.MaxAge <= 0 {
+		return false, nil
+	}
+	cutoff := now.Add(-c.MaxAge)
+	if stats, err := readMeta(journalFile.FileName); err == nil {
+		return stats.Count == 0 || stats.MaxTimestamp.Before(cutoff), nil
+	}
+	// without a meta file, the last batch is read as a record with its maximal
+	// timestamp, so that an encrypted segment file can be cleaned without the key
+	lastRecord, _, err := journalFile.lastRecord()
+	if err == errJournalFileIsEmpty {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return lastRecord.Timestamp.Before(cutoff), nil
+}
+
+// slowestReaderOffset returns the smallest offset persisted in dir/ofs, or the
+// maximal offset if there is no reader
+func slowestReaderOffset(dir string) (uint64, error) {
+	slowestOffset := uint64(math.MaxUint64)
+	offsets, err := ReadOffsets(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, offset := range offsets {
+		if offset < slowestOffset {
+			slowestOffset = offset
+		}
+	}
+	return slowestOffset, nil
+}
+
+// maintenanceLockName returns the lock file preventing cleaning and compaction
+// from running at the same time
+func maintenanceLockName(dir string) string {
+	return JournalDirPath(dir) + ".mnt.lck"
+}
+
+// removeSegment removes a segment file and then its index and meta files
+func removeSegment(file string) error {
+	for _, name := range []string{file, indexFileName(file), timeIndexFileName(file), metaFileName(file)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start runs Clean every interval in a goroutine until Close is called
+func (c *Cleaner) Start(interval time.Duration) {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := c.Clean()
+				if c.OnClean != nil {
+					c.OnClean(removed, err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the goroutine started by Start
+func (c *Cleaner) Close() error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package sej
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCleaner(t *testing.T) {
+	now := time.Now()
+	for _, testcase := range []struct {
+		name        string
+		maxAge      time.Duration
+		maxBytes    int64
+		maxSegments int
+		reader      uint64
+		removed     []uint64
+	}{
+		{name: "no rule", reader: 4},
+		{name: "age", maxAge: 150 * time.Minute, reader: 4, removed: []uint64{0, 1}},
+		{name: "bytes", maxBytes: int64(2 * (headerSize + metaSize + 1)), reader: 4, removed: []uint64{0, 1, 2}},
+		{name: "segments", maxSegments: 2, reader: 4, removed: []uint64{0, 1, 2}},
+		{name: "active", maxSegments: 1, reader: 4, removed: []uint64{0, 1, 2, 3}},
+		{name: "slow reader", maxSegments: 1, reader: 2, removed: []uint64{0, 1}},
+	} {
+		func() {
+			path := newTestPath(t)
+			// one message per segment, the last segment is empty
+			w := newTestWriter(t, path, 1)
+			for i := 4; i > 0; i-- {
+				if err := w.Append(&Message{Timestamp: now.Add(-time.Duration(i) * time.Hour), Value: []byte("a")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			closeTestWriter(t, w)
+			ofs, err := NewOffset(path, "reader", FirstOffset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ofs.Commit(testcase.reader); err != nil {
+				t.Fatal(err)
+			}
+			ofs.Close()
+
+			c := NewCleaner(path)
+			c.MaxAge = testcase.maxAge
+			c.MaxBytes = testcase.maxBytes
+			c.MaxSegments = testcase.maxSegments
+			removed, err := c.Clean()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []string
+			for _, offset := range testcase.removed {
+				file := journalFileName(JournalDirPath(path), offset)
+				expected = append(expected, file)
+				if _, err := os.Stat(indexFileName(file)); !os.IsNotExist(err) {
+					t.Fatalf("%s: expect index of %s removed but got %v", testcase.name, file, err)
+				}
+				if _, err := os.Stat(metaFileName(file)); !os.IsNotExist(err) {
+					t.Fatalf("%s: expect meta of %s removed but got %v", testcase.name, file, err)
+				}
+			}
+			if !reflect.DeepEqual(removed, expected) {
+				t.Fatalf("%s: expect removed %v but got %v", testcase.name, expected, removed)
+			}
+		}()
+	}
+}
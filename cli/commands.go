@@ -1,13 +1,18 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -28,26 +33,46 @@ func (c *FileCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	firstMsg, err := jf.FirstMessage()
+	header, err := jf.Header()
 	if err != nil {
 		return err
 	}
-	fmt.Println("first:")
-	fmt.Println("    offset:", firstMsg.Offset)
-	fmt.Println("    timestamp:", firstMsg.Timestamp)
-	lastMsg, err := jf.LastMessage()
+	if header != nil {
+		fmt.Println("header:")
+		fmt.Println("    version:", header.Version)
+		fmt.Println("    created:", header.Created)
+		fmt.Println("    writer:", header.WriterID)
+		fmt.Println("    compacted:", header.Compacted)
+		fmt.Println("    cipher:", header.Cipher)
+		fmt.Println("    key:", header.KeyID)
+	}
+	stats, err := jf.Stats()
 	if err != nil {
 		return err
 	}
-	fmt.Println("last:")
-	fmt.Println("    offset:", lastMsg.Offset)
-	fmt.Println("    timestamp:", lastMsg.Timestamp)
+	fmt.Println("stats:")
+	fmt.Println("    count:", stats.Count)
+	fmt.Println("    first offset:", stats.FirstOffset)
+	fmt.Println("    last offset:", stats.LastOffset)
+	fmt.Println("    min timestamp:", stats.MinTimestamp)
+	fmt.Println("    max timestamp:", stats.MaxTimestamp)
+	fmt.Println("    size:", stats.Size)
+	types := make([]int, 0, len(stats.Types))
+	for typ := range stats.Types {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+	for _, typ := range types {
+		fmt.Printf("    type %d: %d\n", typ, stats.Types[byte(typ)])
+	}
+	fmt.Printf("    checksum: %08x\n", stats.Checksum)
 	return nil
 }
 
 type TimestampCommand struct {
 	JournalDirConfig `positional-args:"yes"  required:"yes"`
-	Offset           string `
+	KeyConfig
+	Offset string `
 		long:"offset"
 		description:"the offset"`
 }
@@ -64,10 +89,15 @@ func (d *TimestampCommand) Execute(args []string) error {
 		return err
 	}
 
-	s, err := sej.NewScanner(d.Dir, offset)
+	keys, err := d.keyProvider()
 	if err != nil {
 		return err
 	}
+	s, err := sej.NewScannerOptions(context.Background(), d.Dir, offset, sej.ScannerOptions{KeyProvider: keys})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
 	if s.Offset() != offset {
 		return fmt.Errorf("fail to scan to offset %d in %s", offset, d.Dir)
 	}
@@ -78,12 +108,13 @@ func (d *TimestampCommand) Execute(args []string) error {
 
 type ScanCommand struct {
 	JournalDirConfig `positional-args:"yes"  required:"yes"`
-	Start            Timestamp `
+	KeyConfig
+	Start Timestamp `
 	long:"start"
 	description:"start time"`
 	End Timestamp `
 	long:"end"
-	description:"start time"`
+	description:"end time"`
 	Type byte `
 	long:"type"
 	description:"message type"`
@@ -106,35 +137,36 @@ func (c *CountCommand) Execute(args []string) error {
 }
 
 func (c *ScanCommand) Execute(args []string) error {
-	s, err := sejutil.NewScannerFrom(c.Dir, c.Start.Time)
+	keys, err := c.keyProvider()
+	if err != nil {
+		return err
+	}
+	opts := sej.ScannerOptions{EndTime: c.End.Time, StopAtTail: true, KeyProvider: keys}
+	if c.Type != 0 {
+		opts.Filter = func(msg *sej.Message) bool { return msg.Type == c.Type }
+	}
+	s, err := sej.NewScannerOptions(context.Background(), c.Dir, 0, opts)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
-	s.Timeout = time.Second
+	if err := s.SeekTime(c.Start.Time); err != nil {
+		return err
+	}
 	cnt := 0
-	overCount := 0
-scan:
 	for s.Scan() {
-		msg := s.Message()
-		if msg.Timestamp.Before(c.End.Time) {
-			if c.Type == 0 || msg.Type == c.Type {
-				if !c.Count {
-					line, err := DefaultFormatter.Sprint(msg)
-					if err != nil {
-						fmt.Println(err)
-						break scan
-					}
-					fmt.Println(line)
-				}
-				cnt++
+		if !c.Count {
+			line, err := DefaultFormatter.Sprint(s.Message())
+			if err != nil {
+				fmt.Println(err)
+				break
 			}
-		} else {
-			overCount++
-		}
-		if overCount > 5000 {
-			break
+			fmt.Println(line)
 		}
+		cnt++
+	}
+	if err := s.Err(); err != nil && err != io.EOF {
+		return err
 	}
 	if c.Count {
 		fmt.Println(cnt)
@@ -144,7 +176,8 @@ scan:
 
 type ResetCommand struct {
 	JournalDirConfig `positional-args:"yes"  required:"yes"`
-	Start            Timestamp `
+	KeyConfig
+	Start Timestamp `
 	long:"start"
 	description:"start time"`
 	Offset string `
@@ -165,15 +198,21 @@ func (c *ResetCommand) Execute(args []string) error {
 		return err
 	}
 	defer offset.Close()
-	s, err := sejutil.NewScannerFrom(c.Dir, c.Start.Time)
+	keys, err := c.keyProvider()
+	if err != nil {
+		return err
+	}
+	s, err := sejutil.NewScannerFrom(c.Dir, c.Start.Time, keys)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
-	msg := s.Message()
+	resetOffset := s.Offset()
 	fmt.Println("current-offset:", offset.Value())
-	fmt.Println("reset-time:", msg.Timestamp)
-	fmt.Println("reset-offset:", msg.Offset)
+	if s.Scan() {
+		fmt.Println("reset-time:", s.Message().Timestamp)
+	}
+	fmt.Println("reset-offset:", resetOffset)
 	fmt.Println("reset:", c.Reset)
 
 	if c.Reset {
@@ -182,13 +221,14 @@ func (c *ResetCommand) Execute(args []string) error {
 			return err
 		}
 		defer offset.Close()
-		return offset.Commit(msg.Offset)
+		return offset.Commit(resetOffset)
 	}
 	return nil
 }
 
 type DumpCommand struct {
 	JournalFileConfig `positional-args:"yes"  required:"yes"`
+	KeyConfig
 }
 
 type JournalFileConfig struct {
@@ -196,23 +236,48 @@ type JournalFileConfig struct {
 }
 
 func (d *DumpCommand) Execute(args []string) error {
+	file, err := os.Open(d.JournalFile)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer file.Close()
+	header, err := sej.ReadSegmentHeader(file)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if header != nil {
+		fmt.Println("version:", header.Version)
+		fmt.Println("created:", header.Created)
+		fmt.Println("writer:", header.WriterID)
+		fmt.Println("compacted:", header.Compacted)
+		fmt.Println("cipher:", header.Cipher)
+		fmt.Println("key:", header.KeyID)
+	}
+	keys, err := d.keyProvider()
+	if err != nil {
+		return err
+	}
+	r := sej.NewMessageReader(file)
+	if err := r.SetKey(header, keys); err != nil {
+		return err
+	}
 	var msg sej.Message
 	for {
-		file, err := os.Open(d.JournalFile)
-		if err != nil {
-			return errors.Wrap(err)
-		}
-		defer file.Close()
-		if _, err := msg.ReadFrom(file); err != nil {
+		if _, err := r.ReadMessage(&msg); err != nil {
 			if err == io.EOF {
 				return nil
 			}
 			return err
 		}
 		fmt.Println("offset:", msg.Offset)
+		for _, h := range msg.Headers {
+			fmt.Printf("header: %s: %x (%s)\n", h.Name, h.Value, string(h.Value))
+		}
 		fmt.Printf("message: %x (%s)\n", msg.Value, string(msg.Value))
 	}
-	return nil
 }
 
 type OffsetCommand struct {
@@ -244,6 +309,40 @@ type JournalDirConfig struct {
 	Dir string
 }
 
+type KeyConfig struct {
+	KeyFile string `
+		long:"keys"
+		description:"file of the keys decrypting encrypted journal files, one \"key-id hex-key\" per line, the last one being current"`
+}
+
+// keyProvider returns the keys in the key file, or nil without a key file
+func (c *KeyConfig) keyProvider() (sej.KeyProvider, error) {
+	if c.KeyFile == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	keys := &sej.StaticKeys{Keys: make(map[string][]byte)}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid key line %q in %s", line, c.KeyFile)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in %s: %s", fields[0], c.KeyFile, err.Error())
+		}
+		keys.Keys[fields[0]] = key
+		keys.CurrentID = fields[0]
+	}
+	return keys, nil
+}
+
 type TailCommand struct {
 	Count int `
 		long:"count"
@@ -254,43 +353,33 @@ type TailCommand struct {
 		default:"bson"
 		description:"encoding format of the message"`
 	JournalDirConfig `positional-args:"yes"  required:"yes"`
+	KeyConfig
 }
 
 func (c *TailCommand) Execute(args []string) error {
-	dir, err := sej.OpenJournalDir(sej.JournalDirPath(c.Dir))
+	keys, err := c.keyProvider()
 	if err != nil {
 		return err
 	}
-	earlist := dir.First().FirstOffset
-	latest, err := dir.Last().LastOffset()
+	scanner, err := sej.NewReverseScannerKeys(c.Dir, math.MaxUint64, keys)
 	if err != nil {
 		return err
 	}
-	offset := int(latest) - c.Count
-	if offset < int(earlist) {
-		offset = int(earlist)
-	}
-	scanner, err := sej.NewScanner(c.Dir, uint64(offset))
-	if err != nil {
-		return err
-	}
-	scanner.Timeout = time.Second
-	if scanner.Err() != nil {
-		return scanner.Err()
-	}
-	cnt := 0
-scan:
-	for scanner.Scan() {
+	defer scanner.Close()
+	var lines []string
+	for len(lines) < c.Count && scanner.Scan() {
 		line, err := DefaultFormatter.Sprint(scanner.Message())
 		if err != nil {
 			fmt.Println(err)
-			break scan
-		}
-		fmt.Println(line)
-		cnt++
-		if cnt >= int(c.Count) {
 			break
 		}
+		lines = append(lines, line)
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		fmt.Println(lines[i])
 	}
 	return nil
 }
@@ -310,14 +399,28 @@ func (format Format) Sprint(msg *sej.Message) (string, error) {
 			return "", err
 		}
 	default:
-		return string(value), nil
+		if len(msg.Headers) == 0 {
+			return string(value), nil
+		}
+		return sprintJSON(msg, string(value))
 	}
 	hexid.Restore(m)
-	m = map[string]interface{}{
+	return sprintJSON(msg, m)
+}
+
+func sprintJSON(msg *sej.Message, value interface{}) (string, error) {
+	m := map[string]interface{}{
 		"key":       string(msg.Key),
 		"timestamp": msg.Timestamp,
 		"type":      msg.Type,
-		"value":     m,
+		"value":     value,
+	}
+	if len(msg.Headers) > 0 {
+		headers := make([]map[string]string, len(msg.Headers))
+		for i, h := range msg.Headers {
+			headers[i] = map[string]string{"name": h.Name, "value": string(h.Value)}
+		}
+		m["headers"] = headers
 	}
 	buf, err := json.Marshal(m)
 	if err != nil {
@@ -330,7 +433,7 @@ type OldCommand struct {
 	Days int `
 		long:"days"
 		default:"7"
-		description:"max number of days of journal files kept after cleanning"`
+		description:"max number of days of journal files kept after cleaning"`
 	JournalDirConfig `positional-args:"yes"  required:"yes"`
 }
 
@@ -362,15 +465,15 @@ func (c *OldCommand) Execute(args []string) error {
 
 	daysAgo := time.Now().Add(-time.Duration(c.Days) * time.Hour * 24)
 	for _, journalFile := range dir.Files[:len(dir.Files)-1] {
-		lastMessage, err := journalFile.LastMessage()
+		stats, err := journalFile.Stats()
 		if err != nil {
 			return errors.Wrap(err)
 		}
-		if slowestOffset <= lastMessage.Offset {
-			log.Printf("cannot clean %s (%d-%d) because of slow reader %s\n", journalFile.FileName, journalFile.FirstOffset, lastMessage.Offset, slowestReader)
+		if stats.Count > 0 && slowestOffset <= stats.LastOffset {
+			log.Printf("cannot clean %s (%d-%d) because of slow reader %s\n", journalFile.FileName, journalFile.FirstOffset, stats.LastOffset, slowestReader)
 			break
 		}
-		if !lastMessage.Timestamp.Before(daysAgo) {
+		if !stats.MaxTimestamp.Before(daysAgo) {
 			break
 		}
 		fmt.Println(journalFile.FileName)
@@ -378,6 +481,59 @@ func (c *OldCommand) Execute(args []string) error {
 	return nil
 }
 
+type CleanCommand struct {
+	Days int `
+		long:"days"
+		description:"max number of days of journal files kept after cleaning, 0 means no limit"`
+	MaxBytes int64 `
+		long:"max-bytes"
+		description:"max total bytes of journal files kept after cleaning, 0 means no limit"`
+	MaxSegments int `
+		long:"max-segments"
+		description:"max number of journal files kept after cleaning, 0 means no limit"`
+	JournalDirConfig `positional-args:"yes"  required:"yes"`
+}
+
+func (c *CleanCommand) Execute(args []string) error {
+	if c.Days < 0 || c.MaxBytes < 0 || c.MaxSegments < 0 {
+		return errors.New("retention rules must not be negative")
+	}
+	cleaner := sej.NewCleaner(c.Dir)
+	cleaner.MaxAge = time.Duration(c.Days) * time.Hour * 24
+	cleaner.MaxBytes = c.MaxBytes
+	cleaner.MaxSegments = c.MaxSegments
+	removed, err := cleaner.Clean()
+	for _, file := range removed {
+		log.Printf("removed %s\n", file)
+	}
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+type CompactCommand struct {
+	JournalDirConfig `positional-args:"yes"  required:"yes"`
+	KeyConfig
+}
+
+func (c *CompactCommand) Execute(args []string) error {
+	keys, err := c.keyProvider()
+	if err != nil {
+		return err
+	}
+	compactor := sej.NewCompactor(c.Dir)
+	compactor.KeyProvider = keys
+	compacted, err := compactor.Compact()
+	for _, file := range compacted {
+		log.Printf("compacted %s\n", file)
+	}
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
 type Timestamp struct {
 	time.Time
 }
@@ -394,23 +550,9 @@ func (t *Timestamp) UnmarshalFlag(value string) error {
 }
 
 func readOffsets(dir string) (map[string]uint64, error) {
-	offsets := make(map[string]uint64)
-	ofsFiles, err := filepath.Glob(path.Join(sej.OffsetDirPath(dir), "*.ofs"))
+	offsets, err := sej.ReadOffsets(dir)
 	if err != nil {
 		return nil, errors.Wrap(err)
 	}
-	for _, ofsFile := range ofsFiles {
-		f, err := os.Open(ofsFile)
-		if err != nil {
-			return nil, errors.Wrap(err)
-		}
-		offset, err := sej.ReadOffset(f)
-		if err != nil && err != io.EOF {
-			f.Close()
-			return nil, errors.Wrap(err)
-		}
-		f.Close()
-		offsets[ofsFile] = offset
-	}
 	return offsets, nil
 }
@@ -35,6 +35,14 @@ type Command struct {
                 command:"old"
                 description:"print old journal files according to rules"`
 
+	Clean CleanCommand `
+                command:"clean"
+                description:"delete old journal files according to rules"`
+
+	Compact CompactCommand `
+                command:"compact"
+                description:"keep only the last message of each key in closed journal files"`
+
 	File FileCommand `
                 command:"file"
                 description:"print info about a journal file"`
@@ -0,0 +1,239 @@
+package sej
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// TypeTombstone is the reserved message type marking the deletion of a key.
+// Compaction removes all the messages of the key before a tombstone, and
+// removes the tombstone itself once all the readers have read it.
+const TypeTombstone = 0xff
+
+// compactExt is appended to the name of a segment file being compacted
+const compactExt = ".cmp"
+
+// Compactor rewrites the closed segment files of a journal directory, keeping
+// only the last message of each key. Messages without a key are always kept.
+// The offsets of the kept messages are preserved, so there are gaps between
+// offsets in a compacted segment file, which is marked in its header.
+type Compactor struct {
+	dir string
+
+	// KeyProvider provides the keys of encrypted segment files, whose kept
+	// messages are encrypted again with the same key
+	KeyProvider KeyProvider
+}
+
+// NewCompactor creates a compactor for the journal directory dir
+func NewCompactor(dir string) *Compactor {
+	return &Compactor{dir: dir}
+}
+
+// Compact compacts the closed segment files and returns the names of the
+// segment files that have been rewritten. Each compacted segment file is
+// swapped into the journal directory atomically by renaming.
+func (c *Compactor) Compact() ([]string, error) {
+	lock, err := openFileLock(maintenanceLockName(c.dir))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := removeStaleCompacted(JournalDirPath(c.dir)); err != nil {
+		return nil, err
+	}
+	dir, err := OpenJournalDir(JournalDirPath(c.dir))
+	if err != nil {
+		return nil, err
+	}
+	closed := dir.Files[:len(dir.Files)-1]
+	slowestOffset, err := slowestReaderOffset(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]uint64)
+	for i := range closed {
+		if err := scanSegment(closed[i].FileName, c.KeyProvider, func(msg *Message) error {
+			if len(msg.Key) > 0 {
+				latest[string(msg.Key)] = msg.Offset
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	keep := func(msg *Message) bool {
+		if len(msg.Key) == 0 {
+			return true
+		}
+		if latest[string(msg.Key)] != msg.Offset {
+			return false
+		}
+		return msg.Type != TypeTombstone || msg.Offset >= slowestOffset
+	}
+
+	var compacted []string
+	for i := range closed {
+		removed := false
+		if err := scanSegment(closed[i].FileName, c.KeyProvider, func(msg *Message) error {
+			removed = removed || !keep(msg)
+			return nil
+		}); err != nil {
+			return compacted, err
+		}
+		if !removed {
+			continue
+		}
+		if err := compactSegment(closed[i].FileName, c.KeyProvider, keep); err != nil {
+			return compacted, err
+		}
+		compacted = append(compacted, closed[i].FileName)
+	}
+	return compacted, nil
+}
+
+// removeStaleCompacted removes the temporary files left in dir by a
+// compaction interrupted by a crash, with the maintenance lock held
+func removeStaleCompacted(dir string) error {
+	names, err := filepath.Glob(path.Join(dir, "*"+journalExt+compactExt+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSegment writes the kept messages of a segment file into a temporary
+// file and renames it to the segment file, then replaces its indexes and meta
+// file
+func compactSegment(name string, keys KeyProvider, keep func(*Message) bool) error {
+	tmp := name + compactExt
+	if err := writeCompacted(name, tmp, keys, keep); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := buildIndex(tmp, defaultIndexInterval); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	stats, err := buildStats(tmp, keys)
+	if err == nil {
+		err = writeMeta(tmp, stats)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(indexFileName(tmp))
+		os.Remove(timeIndexFileName(tmp))
+		return err
+	}
+	// a stale index with the new segment file is tolerated by the scanner
+	// but not the reverse, so the segment file is renamed first
+	for _, names := range [][2]string{
+		{tmp, name},
+		{indexFileName(tmp), indexFileName(name)},
+		{timeIndexFileName(tmp), timeIndexFileName(name)},
+		{metaFileName(tmp), metaFileName(name)},
+	} {
+		if err := os.Rename(names[0], names[1]); err != nil {
+			return err
+		}
+	}
+	return syncDir(path.Dir(name))
+}
+
+// writeCompacted writes the kept messages of a segment file into tmp. The
+// messages of an encrypted segment file are encrypted one by one like a
+// Writer without Codec.
+func writeCompacted(name, tmp string, keys KeyProvider, keep func(*Message) bool) error {
+	header := SegmentHeader{Created: time.Now().UTC()}
+	if h, err := (&JournalFile{FileName: name}).Header(); err == nil && h != nil {
+		header = *h
+	} else if err != nil && err != errJournalFileIsEmpty {
+		return err
+	}
+	header.Version = segmentVersion
+	header.Compacted = true
+	aead, err := segmentAEAD(&header, keys)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err := header.WriteTo(w); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	var batch batchWriter
+	if err := scanSegment(name, keys, func(msg *Message) error {
+		if !keep(msg) {
+			return nil
+		}
+		if aead == nil {
+			_, err := WriteMessage(w, buf, msg)
+			return err
+		}
+		if err := batch.add(msg, buf); err != nil {
+			return err
+		}
+		_, err := batch.writeTo(w, buf, CodecNone, aead)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// scanSegment calls visit for each message of a closed segment file,
+// decrypted with the keys if it is encrypted
+func scanSegment(name string, keys KeyProvider, visit func(*Message) error) error {
+	f, header, err := openSegment(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := NewMessageReader(bufio.NewReaderSize(f, 65536))
+	if err := r.SetKey(header, keys); err != nil {
+		return err
+	}
+	var msg Message
+	for {
+		if _, err := r.ReadMessage(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := visit(&msg); err != nil {
+			return err
+		}
+	}
+}
+
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,104 @@
+package sej
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	for _, testcase := range []struct {
+		name     string
+		reader   int
+		expected []uint64
+	}{
+		{name: "no reader", reader: -1, expected: []uint64{2, 3, 5}},
+		{name: "tombstone not read", reader: 4, expected: []uint64{2, 3, 4, 5}},
+	} {
+		path := newTestPath(t)
+		// one message per segment, the last segment is empty
+		w := newTestWriter(t, path, 1)
+		for _, msg := range []Message{
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("1")},
+			{Key: []byte("a"), Value: []byte("2")},
+			{Value: []byte("x")},
+			{Key: []byte("b"), Type: TypeTombstone},
+			{Key: []byte("c"), Value: []byte("1")},
+		} {
+			if err := w.Append(&msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeTestWriter(t, w)
+		if testcase.reader >= 0 {
+			ofs, err := NewOffset(path, "reader", FirstOffset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ofs.Commit(uint64(testcase.reader)); err != nil {
+				t.Fatal(err)
+			}
+			ofs.Close()
+		}
+
+		compacted, err := NewCompactor(path).Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compacted) == 0 {
+			t.Fatalf("%s: expect segments compacted", testcase.name)
+		}
+		if compacted, err := NewCompactor(path).Compact(); err != nil || len(compacted) != 0 {
+			t.Fatalf("%s: expect nothing to compact again but got %v, %v", testcase.name, compacted, err)
+		}
+
+		for _, start := range []uint64{0, 1} {
+			s, err := NewScanner(path, start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var offsets []uint64
+			for s.Offset() < 6 && s.Scan() {
+				offsets = append(offsets, s.Message().Offset)
+			}
+			if s.Err() != nil {
+				t.Fatalf("%s: %v", testcase.name, s.Err())
+			}
+			s.Close()
+			if !reflect.DeepEqual(offsets, testcase.expected) {
+				t.Fatalf("%s: scan from %d, expect offsets %v but got %v", testcase.name, start, testcase.expected, offsets)
+			}
+		}
+	}
+}
+
+func TestCompactRemoveStale(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "a", "b")
+	closeTestWriter(t, w)
+	// left by a compaction interrupted by a crash
+	first := journalFileName(JournalDirPath(path), 0)
+	for _, name := range []string{first + compactExt, indexFileName(first + compactExt), metaFileName(first + compactExt)} {
+		if err := ioutil.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewCompactor(path).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(JournalDirPath(path), "*"+compactExt+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expect stale files removed but got %v", names)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal(err)
+	}
+}
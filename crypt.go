@@ -0,0 +1,124 @@
+package sej
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher is the AEAD cipher encrypting the messages of a segment file
+type Cipher byte
+
+const (
+	// CipherNone writes the messages without encryption
+	CipherNone Cipher = iota
+	// CipherAESGCM encrypts with AES-GCM and a 16, 24 or 32 byte key. Its
+	// random 96-bit nonces limit a key to 2^32 encrypted batches or messages
+	// over its whole lifetime, in all the journals and compactions using it.
+	// The limit is not enforced, so the key must be rotated well before it.
+	CipherAESGCM
+	// CipherChaCha20Poly1305 encrypts with ChaCha20-Poly1305 and a 32 byte key,
+	// limited to 2^32 encrypted batches or messages per key like CipherAESGCM
+	CipherChaCha20Poly1305
+	// CipherXChaCha20Poly1305 encrypts with XChaCha20-Poly1305 and a 32 byte
+	// key. Its random 192-bit nonces impose no practical limit on a key, so it
+	// is the only cipher safe for long-lived keys.
+	CipherXChaCha20Poly1305
+)
+
+var (
+	// ErrNoKey is returned when reading an encrypted message without a KeyProvider
+	ErrNoKey = errors.New("no key to decrypt the message")
+	// ErrDecrypt is returned when an encrypted message cannot be authenticated
+	ErrDecrypt = errors.New("message authentication failed")
+)
+
+// KeyProvider provides the keys of encrypted segment files. The ID of the key
+// encrypting a segment file is stored in its header, so that the key can be
+// rotated by changing the current key, which is used by the next segment file.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the key for encrypting a new segment file
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key of the ID for decrypting a segment file
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with the keys in memory
+type StaticKeys struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+// CurrentKey returns the key of CurrentID
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.CurrentID)
+	return k.CurrentID, key, err
+}
+
+// Key returns the key of the ID
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, errors.New("unknown key ID " + id)
+	}
+	return key, nil
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, errors.New("unknown cipher")
+}
+
+// segmentAEAD returns the AEAD decrypting the segment file with the header,
+// or nil if the segment file is not encrypted or keys is nil
+func segmentAEAD(h *SegmentHeader, keys KeyProvider) (cipher.AEAD, error) {
+	if h == nil || h.Cipher == CipherNone || keys == nil {
+		return nil, nil
+	}
+	key, err := keys.Key(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(h.Cipher, key)
+}
+
+// seal encrypts plaintext with a random nonce prepended to the result
+func seal(aead cipher.AEAD, dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if cap(dst) < nonceSize {
+		dst = make([]byte, nonceSize, nonceSize+len(plaintext)+aead.Overhead())
+	}
+	nonce := dst[:nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the result of seal
+func open(aead cipher.AEAD, dst, ciphertext, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := aead.Open(dst[:0], ciphertext[:nonceSize], ciphertext[nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
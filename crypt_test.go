@@ -0,0 +1,232 @@
+package sej
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testKeys returns the keys with the IDs, the last one being current
+func testKeys(ids ...string) *StaticKeys {
+	keys := &StaticKeys{Keys: make(map[string][]byte)}
+	for _, id := range ids {
+		keys.Keys[id] = bytes.Repeat([]byte(id[len(id)-1:]), 32)
+		keys.CurrentID = id
+	}
+	return keys
+}
+
+func TestCryptScan(t *testing.T) {
+	for _, cipher := range []Cipher{CipherAESGCM, CipherChaCha20Poly1305, CipherXChaCha20Poly1305} {
+		for _, codec := range []Codec{CodecNone, CodecZstd} {
+			path := newTestPath(t)
+			keys := testKeys("k1")
+			w := newTestWriterOptions(t, path, WriterOptions{
+				SegmentSize:   1000,
+				IndexInterval: 1,
+				Codec:         codec,
+				BatchSize:     3 * (metaSize + 10),
+				Cipher:        cipher,
+				KeyProvider:   keys,
+			})
+			for i := 0; i < 50; i++ {
+				writeTestMessages(t, w, strconv.Itoa(i))
+			}
+			closeTestWriter(t, w)
+
+			for _, start := range []uint64{0, 1, 25, 49} {
+				s := newTestScanner(t, path, start, ScannerOptions{StopAtTail: true, KeyProvider: keys})
+				for i := start; s.Scan(); i++ {
+					if msg := s.Message(); msg.Offset != i || string(msg.Value) != strconv.Itoa(int(i)) {
+						t.Fatalf("cipher %d, codec %d: unexpected message %d at %d", cipher, codec, msg.Offset, i)
+					}
+				}
+				if s.Err() != io.EOF || s.Offset() != 50 {
+					t.Fatalf("cipher %d, codec %d: expect EOF at 50 but got %v at %d", cipher, codec, s.Err(), s.Offset())
+				}
+				s.Close()
+			}
+
+			r, err := NewReverseScannerKeys(path, math.MaxUint64, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 49; r.Scan(); i-- {
+				if value := string(r.Message().Value); value != strconv.Itoa(i) {
+					t.Fatalf("cipher %d, codec %d: expect %d but got %s", cipher, codec, i, value)
+				}
+			}
+			if r.Err() != nil || r.Offset() != 0 {
+				t.Fatalf("cipher %d, codec %d: expect offset 0 but got %d, %v", cipher, codec, r.Offset(), r.Err())
+			}
+			r.Close()
+
+			// each segment file has the cipher and the key ID in its header
+			dir, err := OpenJournalDir(JournalDirPath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dir.Files) < 2 {
+				t.Fatalf("expect multiple segment files but got %d", len(dir.Files))
+			}
+			for _, file := range dir.Files {
+				h, err := file.Header()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.Cipher != cipher || h.KeyID != "k1" {
+					t.Fatalf("expect cipher %d with key k1 but got %d with %s", cipher, h.Cipher, h.KeyID)
+				}
+			}
+		}
+	}
+}
+
+func TestCryptWithoutKey(t *testing.T) {
+	path := newTestPath(t)
+	keys := testKeys("k1")
+	w := newTestWriterOptions(t, path, WriterOptions{
+		SegmentSize:   headerSize + 10,
+		IndexInterval: 1,
+		Cipher:        CipherAESGCM,
+		KeyProvider:   keys,
+	})
+	writeTestMessages(t, w, "a", "b", "c", "d")
+	closeTestWriter(t, w)
+
+	// the offsets and the indexes do not need the key
+	offset, err := NewOffset(path, "reader", LastOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset.Value() != 4 {
+		t.Fatalf("expect last offset 4 but got %d", offset.Value())
+	}
+	offset.Close()
+	s := newTestScanner(t, path, 2, ScannerOptions{StopAtTail: true})
+	if s.Offset() != 2 {
+		t.Fatalf("expect offset 2 but got %d", s.Offset())
+	}
+	if s.Scan() || s.Err() != ErrNoKey {
+		t.Fatalf("expect ErrNoKey but got %v", s.Err())
+	}
+	s.Close()
+
+	s = newTestScanner(t, path, 0, ScannerOptions{StopAtTail: true, KeyProvider: testKeys("k2")})
+	if s.Scan() || s.Err() == nil {
+		t.Fatal("expect unknown key error but got nil")
+	}
+	s.Close()
+
+	// a wrong key with the same ID
+	wrongKeys := testKeys("k1")
+	wrongKeys.Keys["k1"] = bytes.Repeat([]byte("x"), 32)
+	s = newTestScanner(t, path, 0, ScannerOptions{StopAtTail: true, KeyProvider: wrongKeys})
+	if s.Scan() || s.Err() != ErrDecrypt {
+		t.Fatalf("expect ErrDecrypt but got %v", s.Err())
+	}
+	s.Close()
+}
+
+func TestCryptKeyRotation(t *testing.T) {
+	path := newTestPath(t)
+	keys := testKeys("k1")
+	opts := WriterOptions{Cipher: CipherChaCha20Poly1305, KeyProvider: keys}
+	w := newTestWriterOptions(t, path, opts)
+	writeTestMessages(t, w, "a", "b")
+	closeTestWriter(t, w)
+
+	// the last file is still appended with its key
+	keys = testKeys("k1", "k2")
+	opts.KeyProvider = keys
+	w = newTestWriterOptions(t, path, opts)
+	writeTestMessages(t, w, "c")
+	closeTestWriter(t, w)
+
+	// "d" is appended to the last file, then a new file is created with the
+	// current key for "e"
+	opts.SegmentSize = 1
+	w = newTestWriterOptions(t, path, opts)
+	writeTestMessages(t, w, "d", "e")
+	closeTestWriter(t, w)
+
+	// the empty last file is rewritten without encryption
+	w = newTestWriterOptions(t, path, WriterOptions{})
+	writeTestMessages(t, w, "f")
+	closeTestWriter(t, w)
+
+	dir, err := OpenJournalDir(JournalDirPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyIDs []string
+	for _, file := range dir.Files {
+		h, err := file.Header()
+		if err == errJournalFileIsEmpty {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		keyIDs = append(keyIDs, h.KeyID)
+	}
+	if ids := strings.Join(keyIDs, ","); ids != "k1,k2," {
+		t.Fatalf("expect key IDs k1,k2, but got %s", ids)
+	}
+
+	s := newTestScanner(t, path, 0, ScannerOptions{StopAtTail: true, KeyProvider: keys})
+	defer s.Close()
+	values := ""
+	for s.Scan() {
+		values += string(s.Message().Value)
+	}
+	if s.Err() != io.EOF || values != "abcdef" {
+		t.Fatalf("expect abcdef but got %s, %v", values, s.Err())
+	}
+}
+
+func TestCryptCompact(t *testing.T) {
+	path := newTestPath(t)
+	keys := testKeys("k1")
+	w := newTestWriterOptions(t, path, WriterOptions{SegmentSize: 1000, Cipher: CipherAESGCM, KeyProvider: keys})
+	for _, msg := range []Message{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("a"), Value: []byte("3")},
+	} {
+		if err := w.Append(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+	// roll after the last message
+	w = newTestWriterOptions(t, path, WriterOptions{SegmentSize: 1, Cipher: CipherAESGCM, KeyProvider: keys})
+	if err := w.Append(&Message{Key: []byte("c"), Value: []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+	closeTestWriter(t, w)
+
+	if _, err := NewCompactor(path).Compact(); err != ErrNoKey {
+		t.Fatalf("expect ErrNoKey but got %v", err)
+	}
+	c := NewCompactor(path)
+	c.KeyProvider = keys
+	if compacted, err := c.Compact(); err != nil || len(compacted) != 1 {
+		t.Fatalf("expect 1 segment compacted but got %v, %v", compacted, err)
+	}
+	s := newTestScanner(t, path, 0, ScannerOptions{StopAtTail: true, KeyProvider: keys})
+	defer s.Close()
+	values := ""
+	for s.Scan() {
+		values += string(s.Message().Value)
+	}
+	if s.Err() != io.EOF || values != "234" {
+		t.Fatalf("expect 234 but got %s, %v", values, s.Err())
+	}
+	h, err := (&JournalFile{FileName: JournalDirPath(path) + "/0000000000000000.jnl"}).Header()
+	if err != nil || !h.Compacted || h.Cipher != CipherAESGCM || h.KeyID != "k1" {
+		t.Fatalf("expect compacted and encrypted header but got %v, %v", h, err)
+	}
+}
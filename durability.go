@@ -0,0 +1,211 @@
+package sej
+
+import (
+	"sync"
+	"time"
+)
+
+// DurabilityMode determines when appended messages are synced to the hard drive
+type DurabilityMode int
+
+const (
+	// SyncNone syncs only when a segment file is closed or Writer.Sync is called
+	SyncNone DurabilityMode = iota
+	// SyncInterval flushes and syncs every Durability.Interval
+	SyncInterval
+	// SyncBytes flushes and syncs after every Durability.Bytes bytes appended
+	SyncBytes
+	// SyncGroupCommit blocks Append until its message is synced, sharing one
+	// sync among concurrent Append callers
+	SyncGroupCommit
+)
+
+// Durability is the policy of syncing appended messages to the hard drive
+type Durability struct {
+	Mode     DurabilityMode
+	Interval time.Duration // for SyncInterval
+	Bytes    int           // for SyncBytes
+}
+
+// groupCommit tracks the offset until which all the messages have been synced
+type groupCommit struct {
+	synced  uint64 // all the messages before synced have been synced
+	syncing bool   // a sync is in progress
+	err     error
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+func newGroupCommit(synced uint64) *groupCommit {
+	g := &groupCommit{synced: synced}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// markSynced records that all the messages before offset have been synced
+func (g *groupCommit) markSynced(offset uint64) {
+	g.mu.Lock()
+	if offset > g.synced {
+		g.synced = offset
+	}
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// wait blocks until all the messages before offset have been synced. If no sync
+// is in progress, the caller becomes the leader and calls sync, which returns
+// the offset until which it has synced.
+func (g *groupCommit) wait(offset uint64, sync func() (uint64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < offset && g.err == nil {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		synced, err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		if err != nil {
+			g.err = err
+		} else if synced > g.synced {
+			g.synced = synced
+		}
+		g.cond.Broadcast()
+	}
+	if g.synced >= offset {
+		return nil
+	}
+	return g.err
+}
+
+// waitSynced blocks until all the messages before offset have been synced by
+// others, without syncing by itself
+func (g *groupCommit) waitSynced(offset uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < offset && g.err == nil {
+		g.cond.Wait()
+	}
+	if g.synced >= offset {
+		return nil
+	}
+	return g.err
+}
+
+// close fails the waiters of the messages that will never be synced
+func (g *groupCommit) close() {
+	g.fail(ErrWriterClosed)
+}
+
+// fail fails the waiters of the messages not synced yet with err
+func (g *groupCommit) fail(err error) {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// syncAppended flushes the buffer and syncs the current file without holding
+// the writer lock during the sync, so that other messages can be appended
+// meanwhile. It returns the offset until which the messages have been synced.
+// The sync is skipped if no byte has been written since the last one.
+func (w *Writer) syncAppended() (uint64, error) {
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		w.mu.Unlock()
+		return 0, err
+	}
+	w.local.Broadcast()
+	offset := w.offset
+	if w.unsynced == 0 {
+		w.mu.Unlock()
+		return offset, nil
+	}
+	w.unsynced = 0
+	file := w.file
+	w.fileMu.RLock() // prevent the file from being closed during syncing
+	w.mu.Unlock()
+	err := file.Sync()
+	w.fileMu.RUnlock()
+	return offset, err
+}
+
+// waitDurable blocks until the message before offset is durable according to
+// the durability policy
+func (w *Writer) waitDurable(offset uint64) error {
+	if w.opts.Durability.Mode != SyncGroupCommit {
+		return nil
+	}
+	return w.commit.wait(offset, w.syncAppended)
+}
+
+// afterAppend applies the durability policy after messages are appended
+// with the writer lock held
+func (w *Writer) afterAppend() error {
+	switch w.opts.Durability.Mode {
+	case SyncInterval:
+		if w.syncStop == nil && w.opts.Durability.Interval > 0 {
+			w.startSyncing(w.opts.Durability.Interval)
+		}
+	case SyncBytes:
+		if w.unsynced >= w.opts.Durability.Bytes {
+			if err := w.flush(); err != nil {
+				return err
+			}
+			if err := w.file.Sync(); err != nil {
+				return err
+			}
+			w.unsynced = 0
+			w.commit.markSynced(w.offset)
+		}
+	}
+	return nil
+}
+
+// startSyncing starts a goroutine flushing and syncing the writer periodically.
+// A failure is kept in the writer and returned by the next Append or Flush.
+func (w *Writer) startSyncing(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	w.syncStop, w.syncDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				offset, err := w.syncAppended()
+				if err != nil {
+					w.mu.Lock()
+					if w.err == nil {
+						w.err = err
+					}
+					w.mu.Unlock()
+					w.commit.fail(err)
+					return
+				}
+				w.commit.markSynced(offset)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSyncing stops the goroutine started by startSyncing
+func (w *Writer) stopSyncing() {
+	w.mu.Lock()
+	stop, done := w.syncStop, w.syncDone
+	w.syncStop, w.syncDone = nil, nil
+	w.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
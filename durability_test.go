@@ -0,0 +1,103 @@
+package sej
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDurabilitySyncBytes(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: SyncBytes, Bytes: 2 * (metaSize + 1)}})
+	defer closeTestWriter(t, w)
+
+	file := journalFileName(JournalDirPath(path), 0)
+	writeTestMessages(t, w, "a")
+	if size := fileSize(t, file); size != 0 {
+		t.Fatalf("expect nothing flushed but got %d bytes", size)
+	}
+	writeTestMessages(t, w, "b")
+	if size, expected := fileSize(t, file), int64(headerSize+2*(metaSize+1)); size != expected {
+		t.Fatalf("expect %d bytes flushed but got %d", expected, size)
+	}
+}
+
+func TestDurabilitySyncInterval(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: SyncInterval, Interval: 10 * time.Millisecond}})
+	defer closeTestWriter(t, w)
+
+	writeTestMessages(t, w, "a", "b")
+	file := journalFileName(JournalDirPath(path), 0)
+	expected := int64(headerSize + 2*(metaSize+1))
+	for i := 0; fileSize(t, file) != expected; i++ {
+		if i == 100 {
+			t.Fatal("messages are not flushed periodically")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDurabilitySyncIntervalError(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: SyncInterval, Interval: 10 * time.Millisecond}})
+	writeTestMessages(t, w, "a")
+
+	// fail the next sync
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.file.Close()
+	w.unsynced = 1
+	w.mu.Unlock()
+	for i := 0; w.Flush() == nil; i++ {
+		if i == 100 {
+			t.Fatal("expect the sync error returned by Flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.Append(&Message{Value: []byte("b")}); err == nil {
+		t.Fatal("expect the sync error returned by Append")
+	}
+	w.Close()
+}
+
+func TestDurabilityGroupCommit(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{Durability: Durability{Mode: SyncGroupCommit}})
+
+	const n = 100
+	file := journalFileName(JournalDirPath(path), 0)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := Message{Value: []byte(strconv.Itoa(i % 10))}
+			if err := w.Append(&msg); err != nil {
+				t.Error(err)
+				return
+			}
+			minSize := int64(headerSize + int(msg.Offset+1)*(metaSize+1))
+			if size := fileSize(t, file); size < minSize {
+				t.Errorf("offset %d: expect at least %d bytes synced but got %d", msg.Offset, minSize, size)
+			}
+		}(i)
+	}
+	wg.Wait()
+	closeTestWriter(t, w)
+	if size, expected := fileSize(t, file), int64(headerSize+n*(metaSize+1)); size != expected {
+		t.Fatalf("expect %d bytes but got %d", expected, size)
+	}
+}
+
+func fileSize(t *testing.T, file string) int64 {
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Size()
+}
@@ -8,18 +8,33 @@ import (
 )
 
 var (
-	// ErrCRC is returned when the CRC of an message value does not match the stored CRC
+	// ErrCRC is returned when the CRC of a message does not match the stored CRC
 	ErrCRC = errors.New("CRC mismatch")
-	// ErrTimeout is returned when no message can be obtained within Reader.Timeout
+	// ErrTimeout is returned when no message can be obtained within ScannerOptions.Timeout
 	ErrTimeout = errors.New("read timeout")
+	// ErrWriterClosed is returned when appending to a closed writer
+	ErrWriterClosed = errors.New("writer is closed")
 )
 
 // internal errors
 var (
 	// errOffsetTooSmall is returned when the journal file containing the offset has been cleaned up
 	errOffsetTooSmall = errors.New("offset is too small")
+	// errCorruptionNotAtTail is returned when a corrupted message is followed by
+	// other data, so that it is not truncated
+	errCorruptionNotAtTail = errors.New("corrupted message is not at the end of the file")
 )
 
+// OptionError is returned when an option of a writer or a scanner is invalid
+type OptionError struct {
+	Option string
+	Value  interface{}
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid option %s: %v", e.Option, e.Value)
+}
+
 // CorruptionError is returned when the last message of a segmented journal file is corrupted
 type CorruptionError struct {
 	File      string
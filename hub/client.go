@@ -60,6 +60,7 @@ func (c *Client) Send(messages []sej.Message) error {
 			Type:      uint32(messages[i].Type),
 			Key:       messages[i].Key,
 			Value:     messages[i].Value,
+			Headers:   toHeaders(messages[i].Headers),
 		}
 	}
 
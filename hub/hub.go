@@ -1,2 +1,26 @@
 //go:generate protoc -I . hub.proto --go_out=plugins=grpc:.
 package hub
+
+import "h12.io/sej"
+
+func toHeaders(headers []sej.Header) []*Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	hs := make([]*Header, len(headers))
+	for i := range headers {
+		hs[i] = &Header{Name: headers[i].Name, Value: headers[i].Value}
+	}
+	return hs
+}
+
+func fromHeaders(headers []*Header) []sej.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	hs := make([]sej.Header, len(headers))
+	for i, h := range headers {
+		hs[i] = sej.Header{Name: h.Name, Value: h.Value}
+	}
+	return hs
+}
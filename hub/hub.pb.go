@@ -13,6 +13,7 @@ It has these top-level messages:
 	GetRequest
 	GetResponse
 	Message
+	Header
 */
 package hub
 
@@ -125,11 +126,12 @@ func (m *GetResponse) GetMessages() []*Message {
 }
 
 type Message struct {
-	Offset    uint64 `protobuf:"varint,1,opt,name=Offset" json:"Offset,omitempty"`
-	Timestamp int64  `protobuf:"varint,2,opt,name=Timestamp" json:"Timestamp,omitempty"`
-	Type      uint32 `protobuf:"varint,3,opt,name=Type" json:"Type,omitempty"`
-	Key       []byte `protobuf:"bytes,4,opt,name=Key,proto3" json:"Key,omitempty"`
-	Value     []byte `protobuf:"bytes,5,opt,name=Value,proto3" json:"Value,omitempty"`
+	Offset    uint64    `protobuf:"varint,1,opt,name=Offset" json:"Offset,omitempty"`
+	Timestamp int64     `protobuf:"varint,2,opt,name=Timestamp" json:"Timestamp,omitempty"`
+	Type      uint32    `protobuf:"varint,3,opt,name=Type" json:"Type,omitempty"`
+	Key       []byte    `protobuf:"bytes,4,opt,name=Key,proto3" json:"Key,omitempty"`
+	Value     []byte    `protobuf:"bytes,5,opt,name=Value,proto3" json:"Value,omitempty"`
+	Headers   []*Header `protobuf:"bytes,6,rep,name=Headers" json:"Headers,omitempty"`
 }
 
 func (m *Message) Reset()                    { *m = Message{} }
@@ -172,12 +174,44 @@ func (m *Message) GetValue() []byte {
 	return nil
 }
 
+func (m *Message) GetHeaders() []*Header {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+type Header struct {
+	Name  string `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
+	Value []byte `protobuf:"bytes,2,opt,name=Value,proto3" json:"Value,omitempty"`
+}
+
+func (m *Header) Reset()                    { *m = Header{} }
+func (m *Header) String() string            { return proto.CompactTextString(m) }
+func (*Header) ProtoMessage()               {}
+func (*Header) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *Header) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Header) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*PutRequest)(nil), "hub.PutRequest")
 	proto.RegisterType((*PutResponse)(nil), "hub.PutResponse")
 	proto.RegisterType((*GetRequest)(nil), "hub.GetRequest")
 	proto.RegisterType((*GetResponse)(nil), "hub.GetResponse")
 	proto.RegisterType((*Message)(nil), "hub.Message")
+	proto.RegisterType((*Header)(nil), "hub.Header")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -288,23 +322,26 @@ var _Hub_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("hub.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 288 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x92, 0x4f, 0x4b, 0xc3, 0x40,
-	0x10, 0xc5, 0xbb, 0x6e, 0x5a, 0x9b, 0x49, 0x8b, 0x65, 0x10, 0x59, 0x8a, 0x48, 0xc8, 0x29, 0x78,
-	0xe8, 0xa1, 0x1e, 0xfc, 0x00, 0x16, 0xea, 0x1f, 0xc4, 0xb2, 0x14, 0x6f, 0x82, 0x09, 0x4c, 0x6d,
-	0x20, 0x4d, 0x62, 0x76, 0xf7, 0x50, 0xfc, 0xf2, 0x92, 0xed, 0xda, 0xc4, 0x8b, 0x27, 0x6f, 0x33,
-	0x6f, 0x86, 0x79, 0x3f, 0xde, 0x2e, 0xf8, 0x5b, 0x93, 0xce, 0xaa, 0xba, 0xd4, 0x25, 0xf2, 0xad,
-	0x49, 0xa3, 0x1a, 0x60, 0x65, 0xb4, 0xa4, 0x4f, 0x43, 0x4a, 0xe3, 0x14, 0x86, 0x77, 0x79, 0x46,
-	0x85, 0x7e, 0x58, 0x08, 0x16, 0xb2, 0xd8, 0x97, 0xc7, 0x1e, 0xaf, 0x00, 0x1e, 0x4b, 0x53, 0x17,
-	0x49, 0xbe, 0xc8, 0x6a, 0x71, 0x62, 0xa7, 0x1d, 0x05, 0x63, 0x18, 0x3e, 0x93, 0x52, 0xc9, 0x07,
-	0x29, 0xc1, 0x43, 0x1e, 0x07, 0xf3, 0xd1, 0xac, 0x31, 0x73, 0xa2, 0x3c, 0x4e, 0xa3, 0x31, 0x04,
-	0xd6, 0x53, 0x55, 0x65, 0xa1, 0x28, 0x7a, 0x07, 0x58, 0xd2, 0xbf, 0x20, 0x5c, 0xc0, 0xe0, 0x65,
-	0xb3, 0x51, 0xa4, 0x05, 0x0f, 0x59, 0xec, 0x49, 0xd7, 0x45, 0xb7, 0x10, 0x58, 0x87, 0x83, 0xe1,
-	0x2f, 0x52, 0xf6, 0x27, 0xe9, 0x17, 0x9c, 0xba, 0xba, 0x73, 0x9b, 0x75, 0x6f, 0xe3, 0x25, 0xf8,
-	0xeb, 0x6c, 0x47, 0x4a, 0x27, 0xbb, 0xca, 0x22, 0x71, 0xd9, 0x0a, 0x88, 0xe0, 0xad, 0xf7, 0x15,
-	0x59, 0x9e, 0xb1, 0xb4, 0x35, 0x4e, 0x80, 0x3f, 0xd1, 0x5e, 0x78, 0x21, 0x8b, 0x47, 0xb2, 0x29,
-	0xf1, 0x1c, 0xfa, 0xaf, 0x49, 0x6e, 0x48, 0xf4, 0xad, 0x76, 0x68, 0xe6, 0x6f, 0xc0, 0xef, 0x4d,
-	0x8a, 0xd7, 0xc0, 0x57, 0x46, 0xe3, 0x99, 0x45, 0x6c, 0xdf, 0x6a, 0x3a, 0x69, 0x05, 0x17, 0x64,
-	0xaf, 0xd9, 0x5d, 0xd2, 0xcf, 0x6e, 0x1b, 0xaa, 0xdb, 0xed, 0x64, 0x10, 0xf5, 0xd2, 0x81, 0xfd,
-	0x05, 0x37, 0xdf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x9b, 0x24, 0x2b, 0x8b, 0x12, 0x02, 0x00, 0x00,
+	// 321 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x52, 0xc1, 0x4a, 0xc3, 0x40,
+	0x10, 0xed, 0x76, 0xdb, 0xb4, 0x9d, 0xb4, 0x58, 0x06, 0x91, 0xa5, 0x88, 0x84, 0x80, 0x10, 0x3c,
+	0xf4, 0x50, 0x0f, 0x7e, 0x80, 0x85, 0x54, 0x45, 0x2d, 0x4b, 0xf1, 0x26, 0x98, 0xe0, 0xd4, 0x16,
+	0xda, 0x26, 0x66, 0x77, 0x0f, 0xfd, 0x1d, 0xbf, 0x54, 0xb2, 0x4d, 0x93, 0xe8, 0xc1, 0x93, 0xb7,
+	0xf7, 0xde, 0x0c, 0xef, 0x3d, 0x76, 0x07, 0x7a, 0x2b, 0x13, 0x8f, 0xd3, 0x2c, 0xd1, 0x09, 0xf2,
+	0x95, 0x89, 0xfd, 0x0c, 0x60, 0x6e, 0xb4, 0xa4, 0x4f, 0x43, 0x4a, 0xe3, 0x08, 0xba, 0xb7, 0x9b,
+	0x35, 0xed, 0xf4, 0xdd, 0x54, 0x30, 0x8f, 0x05, 0x3d, 0x59, 0x72, 0xbc, 0x00, 0xb8, 0x4f, 0x4c,
+	0xb6, 0x8b, 0x36, 0xd3, 0x75, 0x26, 0x9a, 0x76, 0x5a, 0x53, 0x30, 0x80, 0xee, 0x23, 0x29, 0x15,
+	0x7d, 0x90, 0x12, 0xdc, 0xe3, 0x81, 0x3b, 0xe9, 0x8f, 0xf3, 0xb0, 0x42, 0x94, 0xe5, 0xd4, 0x1f,
+	0x80, 0x6b, 0x33, 0x55, 0x9a, 0xec, 0x14, 0xf9, 0x6f, 0x00, 0x21, 0xfd, 0x4b, 0x85, 0x33, 0x70,
+	0x9e, 0x97, 0x4b, 0x45, 0x5a, 0x70, 0x8f, 0x05, 0x2d, 0x59, 0x30, 0xff, 0x06, 0xdc, 0x90, 0xca,
+	0xc0, 0x1f, 0x4d, 0xd9, 0x9f, 0x4d, 0xbf, 0x18, 0x74, 0x0a, 0x52, 0x33, 0x67, 0x75, 0x73, 0x3c,
+	0x87, 0xde, 0x62, 0xbd, 0x25, 0xa5, 0xa3, 0x6d, 0x6a, 0x3b, 0x71, 0x59, 0x09, 0x88, 0xd0, 0x5a,
+	0xec, 0x53, 0xb2, 0x85, 0x06, 0xd2, 0x62, 0x1c, 0x02, 0x7f, 0xa0, 0xbd, 0x68, 0x79, 0x2c, 0xe8,
+	0xcb, 0x1c, 0xe2, 0x29, 0xb4, 0x5f, 0xa2, 0x8d, 0x21, 0xd1, 0xb6, 0xda, 0x81, 0xe0, 0x25, 0x74,
+	0x66, 0x14, 0xbd, 0x53, 0xa6, 0x84, 0x63, 0x6b, 0xba, 0xb6, 0xe6, 0x41, 0x93, 0xc7, 0x99, 0x3f,
+	0x01, 0xe7, 0x00, 0xf3, 0xb0, 0xa7, 0x68, 0x4b, 0xc5, 0xbb, 0x59, 0x5c, 0x59, 0x37, 0x6b, 0xd6,
+	0x93, 0x57, 0xe0, 0x33, 0x13, 0xe3, 0x15, 0xf0, 0xb9, 0xd1, 0x78, 0x62, 0x7d, 0xab, 0x3b, 0x18,
+	0x0d, 0x2b, 0xa1, 0xf8, 0xa4, 0x46, 0xbe, 0x1b, 0xd2, 0x71, 0x37, 0xa4, 0x5f, 0xbb, 0xb5, 0xf7,
+	0xf5, 0x1b, 0xb1, 0x63, 0x2f, 0xec, 0xfa, 0x7b, 0x00, 0xaf, 0x4e, 0x9a, 0x94, 0x6e, 0x02, 0x00,
+	0x00,
 }
@@ -27,6 +27,23 @@ func TestHub(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+func TestHubConcurrentPut(t *testing.T) {
+	tt := newHubTest(t)
+	defer tt.Close()
+	sejMessages := toMsgSlice([]string{"a", "b", "c", "d", "e"})
+	// the same messages sent concurrently are appended only once
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- tt.Send(sejMessages) }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tt.VerifyServerMessages(sejMessages)
+}
+
 func BenchmarkHubBatch1000(b *testing.B) {
 	tt := newHubTest(b)
 	defer tt.Close()
@@ -78,7 +78,13 @@ type JournalCopyHandler struct {
 }
 
 func NewJournalCopyHandler(dir string) *JournalCopyHandler {
-	return &JournalCopyHandler{ws: newWriters(dir)}
+	return NewJournalCopyHandlerOptions(dir, sej.WriterOptions{})
+}
+
+// NewJournalCopyHandlerOptions creates a handler like NewJournalCopyHandler,
+// writing the copied messages with opts, e.g. encrypted with a Cipher
+func NewJournalCopyHandlerOptions(dir string, opts sej.WriterOptions) *JournalCopyHandler {
+	return &JournalCopyHandler{ws: newWriters(dir, opts)}
 }
 
 func (h *JournalCopyHandler) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
@@ -86,21 +92,32 @@ func (h *JournalCopyHandler) Put(ctx context.Context, req *PutRequest) (*PutResp
 	if err != nil {
 		return nil, errors.Wrap(err, "fail to get writer for client "+req.ClientID)
 	}
+	// the offsets are checked and appended atomically, so that nothing is
+	// appended if they are out of order
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	offset := writer.Offset()
+	msgs := make([]sej.Message, 0, len(req.Messages))
 	for _, msg := range req.Messages {
-		if msg.Offset > writer.Offset() {
-			return nil, errors.Wrapf(err, "offset out of order, msg: %d, writer %d", msg.Offset, writer.Offset())
-		} else if msg.Offset < writer.Offset() { // redundant
+		expected := offset + uint64(len(msgs))
+		if msg.Offset < expected { // redundant
 			continue
+		} else if msg.Offset > expected {
+			return nil, errors.Errorf("offset out of order, msg: %d, writer %d", msg.Offset, expected)
 		}
-		if err := writer.Append(&sej.Message{
-			Offset:    msg.Offset,
+		msgs = append(msgs, sej.Message{
 			Timestamp: time.Unix(0, msg.Timestamp).UTC(),
 			Type:      byte(msg.Type),
 			Key:       msg.Key,
+			Headers:   fromHeaders(msg.Headers),
 			Value:     msg.Value,
-		}); err != nil {
-			return nil, err
-		}
+		})
+	}
+	if len(msgs) == 0 {
+		return &PutResponse{}, nil
+	}
+	if _, err := writer.AppendBatch(msgs); err != nil {
+		return nil, err
 	}
 	if err := writer.Flush(); err != nil {
 		return nil, err
@@ -10,15 +10,24 @@ import (
 )
 
 type writers struct {
-	dir string
-	m   map[string]*sej.Writer
-	mu  sync.Mutex
+	dir  string
+	opts sej.WriterOptions
+	m    map[string]*copyWriter
+	mu   sync.Mutex
 }
 
-func newWriters(dir string) *writers {
+// copyWriter writes a copied journal. Its mutex is held while checking the
+// offsets of the copied messages and appending them.
+type copyWriter struct {
+	*sej.Writer
+	mu sync.Mutex
+}
+
+func newWriters(dir string, opts sej.WriterOptions) *writers {
 	return &writers{
-		dir: dir,
-		m:   make(map[string]*sej.Writer),
+		dir:  dir,
+		opts: opts,
+		m:    make(map[string]*copyWriter),
 	}
 }
 
@@ -27,7 +36,7 @@ var (
 	rxJournalDir = regexp.MustCompile(`[0-9a-zA-Z_\-\.]`)
 )
 
-func (w *writers) Writer(clientID, journalDir string) (*sej.Writer, error) {
+func (w *writers) Writer(clientID, journalDir string) (*copyWriter, error) {
 	if !rxClientID.MatchString(clientID) {
 		return nil, errors.New("invalid clientID " + clientID)
 	}
@@ -39,11 +48,11 @@ func (w *writers) Writer(clientID, journalDir string) (*sej.Writer, error) {
 	key := clientID + "." + journalDir
 	writer, ok := w.m[key]
 	if !ok {
-		var err error
-		writer, err = sej.NewWriter(path.Join(w.dir, key))
+		sw, err := sej.NewWriterOptions(path.Join(w.dir, key), w.opts)
 		if err != nil {
 			return nil, err
 		}
+		writer = &copyWriter{Writer: sw}
 		w.m[key] = writer
 	}
 	return writer, nil
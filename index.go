@@ -0,0 +1,431 @@
+package sej
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	indexExt     = ".idx"
+	timeIndexExt = ".tix"
+	// indexEntrySize is the size of an entry in both the offset and the time index
+	indexEntrySize = 16
+	// defaultIndexInterval is the minimal number of bytes between two index entries
+	defaultIndexInterval = 4096
+)
+
+// indexEntry is an entry of the index of a message in a journal file.
+// The offset index maps Offset to Position and the time index maps Timestamp
+// to Offset. Both indexes have entries for the same messages.
+type indexEntry struct {
+	Offset    uint64
+	Position  int64
+	Timestamp int64 // the maximal timestamp of all the messages until Offset in the journal file
+}
+
+func indexFileName(journalFileName string) string {
+	return strings.TrimSuffix(journalFileName, journalExt) + indexExt
+}
+
+func timeIndexFileName(journalFileName string) string {
+	return strings.TrimSuffix(journalFileName, journalExt) + timeIndexExt
+}
+
+// indexWriter appends entries to the sparse offset and time indexes of a journal file
+type indexWriter struct {
+	file     *os.File
+	timeFile *os.File
+	w        *bufio.Writer
+	tw       *bufio.Writer
+	buf      []byte
+	pending  []indexEntry // entries written by Flush after the journal file is flushed
+	lastPos  int64        // position of the last indexed message
+	last     indexEntry   // the last message, indexed or not
+}
+
+// openIndexWriter opens the indexes of a journal file for appending.
+// Entries beyond the end of the journal file are removed and the missing
+// entries are added by reading the journal file from the last valid entry.
+func openIndexWriter(journalFileName string, interval int) (*indexWriter, error) {
+	w, err := newIndexWriter(journalFileName, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.repair(journalFileName, interval); err != nil {
+		w.file.Close()
+		w.timeFile.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// createIndexWriter creates empty indexes for a new journal file
+func createIndexWriter(journalFileName string) (*indexWriter, error) {
+	return newIndexWriter(journalFileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR)
+}
+
+func newIndexWriter(journalFileName string, flag int) (*indexWriter, error) {
+	file, err := os.OpenFile(indexFileName(journalFileName), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	timeFile, err := os.OpenFile(timeIndexFileName(journalFileName), flag, 0644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &indexWriter{
+		file:     file,
+		timeFile: timeFile,
+		w:        bufio.NewWriterSize(file, 4096),
+		tw:       bufio.NewWriterSize(timeFile, 4096),
+		buf:      make([]byte, 8),
+		last:     indexEntry{Timestamp: math.MinInt64},
+	}, nil
+}
+
+func (w *indexWriter) repair(journalFileName string, interval int) error {
+	stat, err := os.Stat(journalFileName)
+	if err != nil {
+		return err
+	}
+	entries, err := readIndexEntries(bufio.NewReader(w.file), bufio.NewReader(w.timeFile))
+	if err != nil {
+		return err
+	}
+	valid := sort.Search(len(entries), func(i int) bool { return entries[i].Position >= stat.Size() })
+	for _, f := range []*os.File{w.file, w.timeFile} {
+		if err := f.Truncate(int64(valid) * indexEntrySize); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	var start int64
+	if valid > 0 {
+		w.last = entries[valid-1]
+		start = w.last.Position
+		w.lastPos = start
+	}
+	if err := scanIndex(journalFileName, start, w.lastPos, w.last.Timestamp, int64(interval), func(e indexEntry, indexed bool) error {
+		w.last = e
+		if !indexed {
+			return nil
+		}
+		w.lastPos = e.Position
+		return w.write(e)
+	}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Add adds an entry if the message at pos is at least interval bytes after
+// the last indexed message
+func (w *indexWriter) Add(msg *Message, pos int64, interval int) error {
+	w.last.Offset = msg.Offset
+	w.last.Position = pos
+	if ts := unixNano(msg.Timestamp); ts > w.last.Timestamp {
+		w.last.Timestamp = ts
+	}
+	if pos-w.lastPos < int64(interval) {
+		return nil
+	}
+	w.lastPos = pos
+	return w.write(w.last)
+}
+
+// write keeps the entry in memory until Flush, so that it is never written
+// to the index files before the message it points to is flushed
+func (w *indexWriter) write(e indexEntry) error {
+	w.pending = append(w.pending, e)
+	return nil
+}
+
+// Flush writes the pending entries to the index files, and must be called
+// after the journal file is flushed
+func (w *indexWriter) Flush() error {
+	for _, e := range w.pending {
+		if err := writeIndexEntry(w.w, w.buf, e.Offset, uint64(e.Position)); err != nil {
+			return err
+		}
+		if err := writeIndexEntry(w.tw, w.buf, uint64(e.Timestamp), e.Offset); err != nil {
+			return err
+		}
+	}
+	w.pending = w.pending[:0]
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.tw.Flush()
+}
+
+// Close adds an entry for the last message so that the time index covers
+// all the messages, then closes the index files
+func (w *indexWriter) Close() error {
+	var err error
+	if w.last.Position > w.lastPos {
+		err = w.write(w.last)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	err1 := w.file.Close()
+	err2 := w.timeFile.Close()
+	if err != nil {
+		return err
+	}
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// buildIndex writes the indexes of a journal file that will not be appended anymore
+func buildIndex(journalFileName string, interval int) error {
+	tmp, err := createTempIndex(indexFileName(journalFileName))
+	if err != nil {
+		return err
+	}
+	timeTmp, err := createTempIndex(timeIndexFileName(journalFileName))
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	w := &indexWriter{
+		file:     tmp,
+		timeFile: timeTmp,
+		w:        bufio.NewWriter(tmp),
+		tw:       bufio.NewWriter(timeTmp),
+		buf:      make([]byte, 8),
+		last:     indexEntry{Timestamp: math.MinInt64},
+	}
+	err = scanIndex(journalFileName, 0, 0, math.MinInt64, int64(interval), func(e indexEntry, indexed bool) error {
+		w.last = e
+		if !indexed {
+			return nil
+		}
+		w.lastPos = e.Position
+		return w.write(e)
+	})
+	if err == nil {
+		err = w.Close()
+	} else {
+		tmp.Close()
+		timeTmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), indexFileName(journalFileName))
+	}
+	if err == nil {
+		err = os.Rename(timeTmp.Name(), timeIndexFileName(journalFileName))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		os.Remove(timeTmp.Name())
+		return err
+	}
+	return nil
+}
+
+func createTempIndex(name string) (*os.File, error) {
+	dir, base := path.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	return ioutil.TempFile(dir, base)
+}
+
+// scanIndex reads the journal file from position start and calls visit for
+// each message, indexed is true if the message is at least interval bytes
+// after the previously indexed message
+func scanIndex(journalFileName string, start, lastPos, maxTimestamp, interval int64, visit func(e indexEntry, indexed bool) error) error {
+	f, err := os.Open(journalFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pos := start
+	if start == 0 {
+		if _, err := ReadSegmentHeader(f); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		if pos, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	} else if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	// a batch is indexed as a record without being decrypted or decompressed
+	cr := crcReader{r: bufio.NewReaderSize(f, 65536)}
+	var msg Message
+	for {
+		n, _, err := cr.readRecord(&msg)
+		if err != nil {
+			// an incomplete or corrupted message at the end will be indexed later
+			return nil
+		}
+		if ts := unixNano(msg.Timestamp); ts > maxTimestamp {
+			maxTimestamp = ts
+		}
+		indexed := pos-lastPos >= interval
+		if indexed {
+			lastPos = pos
+		}
+		if err := visit(indexEntry{Offset: msg.Offset, Position: pos, Timestamp: maxTimestamp}, indexed); err != nil {
+			return err
+		}
+		pos += n
+	}
+}
+
+// searchIndex finds the last index entry with offset no larger than the
+// given offset. The indexes are built first if the journal file is closed,
+// i.e. will not be appended anymore, but has no index.
+func (journalFile *JournalFile) searchIndex(offset uint64, closed bool) (indexEntry, bool, error) {
+	if err := journalFile.ensureIndex(closed); err != nil {
+		return indexEntry{}, false, err
+	}
+	return searchIndex(journalFile.FileName, offset)
+}
+
+// searchTimeIndex finds the last index entry with timestamp earlier than t,
+// i.e. all the messages until the offset of the entry are earlier than t.
+// last is true if the entry is the last one in the time index.
+func (journalFile *JournalFile) searchTimeIndex(t time.Time, closed bool) (entry indexEntry, ok, last bool, err error) {
+	if err := journalFile.ensureIndex(closed); err != nil {
+		return indexEntry{}, false, false, err
+	}
+	name := timeIndexFileName(journalFile.FileName)
+	ts := unixNano(t)
+	n, i, err := searchIndexFile(name, func(k, _ uint64) bool {
+		return int64(k) >= ts
+	})
+	if err != nil || i == 0 {
+		return indexEntry{}, false, false, err
+	}
+	k, v, err := readIndexEntry(name, i-1)
+	if err != nil {
+		return indexEntry{}, false, false, err
+	}
+	return indexEntry{Timestamp: int64(k), Offset: v}, true, i == n, nil
+}
+
+func (journalFile *JournalFile) ensureIndex(closed bool) error {
+	if !closed {
+		return nil
+	}
+	for _, name := range []string{indexFileName(journalFile.FileName), timeIndexFileName(journalFile.FileName)} {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return buildIndex(journalFile.FileName, defaultIndexInterval)
+		}
+	}
+	return nil
+}
+
+// searchIndex finds the last offset index entry with offset no larger than
+// the given offset. ok is false if no such entry or no index exists.
+func searchIndex(journalFileName string, offset uint64) (entry indexEntry, ok bool, err error) {
+	name := indexFileName(journalFileName)
+	_, i, err := searchIndexFile(name, func(k, _ uint64) bool {
+		return k > offset
+	})
+	if err != nil || i == 0 {
+		return indexEntry{}, false, err
+	}
+	k, v, err := readIndexEntry(name, i-1)
+	if err != nil {
+		return indexEntry{}, false, err
+	}
+	return indexEntry{Offset: k, Position: int64(v)}, true, nil
+}
+
+// searchIndexFile returns the number of entries n and the smallest index i
+// of the entry for which f is true, or n if there is no such entry.
+// A missing index file is treated as an empty one.
+func searchIndexFile(name string, f func(k, v uint64) bool) (n, i int, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var b [indexEntrySize]byte
+	n = int(stat.Size() / indexEntrySize)
+	i = sort.Search(n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		if _, err = file.ReadAt(b[:], int64(i)*indexEntrySize); err != nil {
+			return true
+		}
+		return f(binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:]))
+	})
+	return n, i, err
+}
+
+func readIndexEntry(name string, i int) (k, v uint64, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	var b [indexEntrySize]byte
+	if _, err := file.ReadAt(b[:], int64(i)*indexEntrySize); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:]), nil
+}
+
+// readIndexEntries reads the entries existing in both the offset and the time index
+func readIndexEntries(r, tr io.Reader) ([]indexEntry, error) {
+	var entries []indexEntry
+	for {
+		var e indexEntry
+		var position, timestamp, offset uint64
+		for _, field := range []struct {
+			r io.Reader
+			v *uint64
+		}{{r, &e.Offset}, {r, &position}, {tr, &timestamp}, {tr, &offset}} {
+			if _, err := readUint64(field.r, field.v); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return entries, nil
+				}
+				return nil, err
+			}
+		}
+		if offset != e.Offset {
+			// the time index does not match the offset index, drop the rest
+			return entries, nil
+		}
+		e.Position, e.Timestamp = int64(position), int64(timestamp)
+		entries = append(entries, e)
+	}
+}
+
+func writeIndexEntry(w io.Writer, buf []byte, k, v uint64) error {
+	if _, err := writeUint64(w, buf, k); err != nil {
+		return err
+	}
+	_, err := writeUint64(w, buf, v)
+	return err
+}
@@ -0,0 +1,171 @@
+package sej
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIndexAppend(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{IndexInterval: 2 * (metaSize + 1)})
+	writeTestMessages(t, w, "0", "1", "2", "3", "4", "5")
+	closeTestWriter(t, w)
+
+	file := journalFileName(JournalDirPath(path), 0)
+	for _, testcase := range []struct {
+		offset   uint64
+		ok       bool
+		expected uint64
+	}{
+		{offset: 0, ok: false},
+		{offset: 1, ok: false},
+		{offset: 2, ok: true, expected: 2},
+		{offset: 3, ok: true, expected: 2},
+		{offset: 4, ok: true, expected: 4},
+		{offset: 5, ok: true, expected: 5}, // the last message is indexed when closing
+		{offset: 100, ok: true, expected: 5},
+	} {
+		entry, ok, err := searchIndex(file, testcase.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != testcase.ok || entry.Offset != testcase.expected {
+			t.Fatalf("offset %d: expect (%d, %v) but got (%d, %v)", testcase.offset, testcase.expected, testcase.ok, entry.Offset, ok)
+		}
+		if ok {
+			expectedPos := int64(headerSize + int(entry.Offset)*(metaSize+1))
+			if entry.Position != expectedPos {
+				t.Fatalf("offset %d: expect position %d but got %d", entry.Offset, expectedPos, entry.Position)
+			}
+		}
+	}
+}
+
+func TestIndexAfterData(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{IndexInterval: 1, BufferSize: 1 << 20})
+	defer closeTestWriter(t, w)
+	// more entries than the buffer of the index files
+	for i := 0; i < 1000; i++ {
+		writeTestMessages(t, w, strconv.Itoa(i))
+	}
+
+	file := journalFileName(JournalDirPath(path), 0)
+	indexSize := func() int64 {
+		stat, err := os.Stat(indexFileName(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+	if size := indexSize(); size != 0 {
+		t.Fatalf("expect no index entry before the messages are flushed but got %d bytes", size)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if size := indexSize(); size != 1000*indexEntrySize {
+		t.Fatalf("expect 1000 index entries after flushing but got %d bytes", size)
+	}
+}
+
+func TestIndexBuildOnDemand(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, headerSize+10000*(metaSize+4))
+	for i := 0; i < 2000; i++ {
+		writeTestMessages(t, w, strconv.Itoa(1000+i))
+	}
+	closeTestWriter(t, w)
+	// roll over so that the first file is closed
+	w = newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "x")
+	closeTestWriter(t, w)
+
+	file := journalFileName(JournalDirPath(path), 0)
+	if err := os.Remove(indexFileName(file)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(path, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(indexFileName(file)); err != nil {
+		t.Fatalf("expect index rebuilt but got %v", err)
+	}
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if msg := string(s.Message().Value); msg != "2500" {
+		t.Fatalf("expect 2500 but got %s", msg)
+	}
+}
+
+func TestIndexRepair(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{IndexInterval: 1})
+	writeTestMessages(t, w, "0", "1", "2", "3")
+	closeTestWriter(t, w)
+
+	// remove the last two messages, making the index stale
+	file := journalFileName(JournalDirPath(path), 0)
+	truncateFile(t, file, 2*(metaSize+1))
+
+	s, err := NewScanner(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Offset() != 2 {
+		t.Fatalf("expect offset 2 but got %d", s.Offset())
+	}
+	s.Close()
+
+	w = newTestWriterOptions(t, path, WriterOptions{IndexInterval: 1})
+	writeTestMessages(t, w, "2", "3")
+	closeTestWriter(t, w)
+	entry, ok, err := searchIndex(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || entry.Offset != 3 {
+		t.Fatalf("expect index entry of 3 but got %v", entry)
+	}
+	Test{t}.VerifyMessageValues(path, "0", "1", "2", "3")
+}
+
+func TestTimeIndex(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{IndexInterval: 1})
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	// timestamps are not necessarily in order
+	for _, sec := range []int{1, 3, 2, 5, 4} {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(sec) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+
+	jf := &JournalFile{FileName: journalFileName(JournalDirPath(path), 0)}
+	for _, testcase := range []struct {
+		sec    int
+		ok     bool
+		offset uint64
+		last   bool
+	}{
+		{sec: 1, ok: false},
+		{sec: 2, ok: true, offset: 0},
+		{sec: 3, ok: true, offset: 0},
+		{sec: 4, ok: true, offset: 2},
+		{sec: 6, ok: true, offset: 4, last: true},
+	} {
+		entry, ok, last, err := jf.searchTimeIndex(base.Add(time.Duration(testcase.sec)*time.Second), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != testcase.ok || entry.Offset != testcase.offset || last != testcase.last {
+			t.Fatalf("%ds: expect (%d, %v, %v) but got (%d, %v, %v)", testcase.sec, testcase.offset, testcase.ok, testcase.last, entry.Offset, ok, last)
+		}
+	}
+}
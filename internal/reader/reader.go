@@ -151,6 +151,9 @@ func (b *Reader) seekCur(offset int) (int64, error) {
 	return b.seekSet(b.ar + offset)
 }
 
+// Buffered returns the number of bytes that can be read from the current buffer.
+func (b *Reader) Buffered() int { return b.w - b.r }
+
 // aw is absolute write position, i.e. file position
 func (b *Reader) aw() int {
 	return b.ar + (b.w - b.r)
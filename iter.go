@@ -0,0 +1,118 @@
+//go:build go1.23
+
+package sej
+
+import (
+	"context"
+	"io"
+	"iter"
+	"time"
+)
+
+// All returns an iterator over the messages in dir/jnl starting from offset
+// from. Like Scanner, it waits for new messages at the end of the journal
+// until the loop breaks. An error other than ErrTimeout is yielded once
+// before the iteration stops. The yielded message is only valid during the
+// iteration.
+func All(dir string, from uint64) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		s, err := NewScanner(dir, from)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer s.Close()
+		for {
+			for s.Scan() {
+				if !yield(s.Message(), nil) {
+					return
+				}
+			}
+			if err := s.Err(); err != ErrTimeout {
+				yield(nil, err)
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over the messages in dir/jnl with offsets in
+// [from, to). It stops at the end of the journal when called instead of
+// waiting for new messages.
+func Range(dir string, from, to uint64) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		end, err := tailOffset(dir)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if to < end {
+			end = to
+		}
+		if end <= from {
+			return
+		}
+		s, err := NewScannerOptions(context.Background(), dir, from, ScannerOptions{EndOffset: end})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer s.Close()
+		yieldMessages(s, yield)
+	}
+}
+
+// TimeRange returns an iterator over the messages in dir/jnl with timestamps in
+// [from, to), starting from the first message no earlier than from found with
+// the time index. Messages out of the range are skipped because timestamps are
+// not necessarily in order. It stops at the end of the journal when called
+// instead of waiting for new messages.
+func TimeRange(dir string, from, to time.Time) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		end, err := tailOffset(dir)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if end == 0 {
+			return
+		}
+		s, err := NewScannerOptions(context.Background(), dir, 0, ScannerOptions{
+			EndOffset: end,
+			Filter: func(msg *Message) bool {
+				return !msg.Timestamp.Before(from) && msg.Timestamp.Before(to)
+			},
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer s.Close()
+		if err := s.SeekTime(from); err != nil {
+			yield(nil, err)
+			return
+		}
+		yieldMessages(s, yield)
+	}
+}
+
+// tailOffset returns the offset after the last readable message in dir/jnl
+func tailOffset(dir string) (uint64, error) {
+	journalDir, err := OpenJournalDir(JournalDirPath(dir))
+	if err != nil {
+		return 0, err
+	}
+	return journalDir.Last().LastReadableOffset()
+}
+
+// yieldMessages yields the messages scanned by s until io.EOF or another error
+func yieldMessages(s *Scanner, yield func(*Message, error) bool) {
+	for s.Scan() {
+		if !yield(s.Message(), nil) {
+			return
+		}
+	}
+	if err := s.Err(); err != io.EOF {
+		yield(nil, err)
+	}
+}
@@ -0,0 +1,109 @@
+//go:build go1.23
+
+package sej
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIterRange(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, headerSize+2*(metaSize+1))
+	writeTestMessages(t, w, "a", "b", "c", "d", "e")
+	flushTestWriter(t, w)
+	defer closeTestWriter(t, w)
+
+	for _, testcase := range []struct {
+		from, to uint64
+		expected string
+	}{
+		{from: 0, to: 100, expected: "abcde"},
+		{from: 1, to: 3, expected: "bc"},
+		{from: 5, to: 100, expected: ""},
+	} {
+		values := ""
+		for msg, err := range Range(path, testcase.from, testcase.to) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			values += string(msg.Value)
+		}
+		if values != testcase.expected {
+			t.Fatalf("[%d, %d): expect %s but got %s", testcase.from, testcase.to, testcase.expected, values)
+		}
+	}
+
+	values := ""
+	for msg, err := range All(path, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		values += string(msg.Value)
+		if msg.Offset == 4 {
+			break
+		}
+	}
+	if values != "de" {
+		t.Fatalf("expect de but got %s", values)
+	}
+}
+
+func TestIterTimeRange(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	// timestamps are not necessarily in order
+	for _, sec := range []int{1, 3, 2, 5, 4} {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(sec) * time.Second), Value: []byte{byte('0' + sec)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestWriter(t, w)
+
+	values := ""
+	for msg, err := range TimeRange(path, base.Add(2*time.Second), base.Add(4*time.Second)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		values += string(msg.Value)
+	}
+	if values != "32" {
+		t.Fatalf("expect 32 but got %s", values)
+	}
+}
+
+func TestIterRangePartialTail(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "a", "b", "c")
+	closeTestWriter(t, w)
+
+	// a message partly written at the tail
+	var buf bytes.Buffer
+	if _, err := WriteMessage(&buf, make([]byte, 8), &Message{Offset: 3, Value: []byte("d")}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(journalFileName(JournalDirPath(path), 0), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(buf.Bytes()[:buf.Len()/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	values := ""
+	for msg, err := range Range(path, 0, 100) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		values += string(msg.Value)
+	}
+	if values != "abc" {
+		t.Fatalf("expect abc but got %s", values)
+	}
+}
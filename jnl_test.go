@@ -2,7 +2,9 @@ package sej
 
 import (
 	"math/rand"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -20,3 +22,47 @@ func TestOpenOrCreateDir(t *testing.T) {
 		t.Fatal("expect dir")
 	}
 }
+
+func TestCorruptedHeader(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "a", "b")
+	closeTestWriter(t, w)
+	dirPath := JournalDirPath(path)
+	corruptHeader := func(offset uint64) {
+		// a header with the magic but a version of 0
+		f, err := os.OpenFile(journalFileName(dirPath, offset), os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{0}, int64(len(segmentMagic)+4)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	corruptHeader(0)
+
+	// the corrupted file is reported only when it is read
+	if _, err := OpenJournalDir(dirPath); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScanner(t, path, 0, ScannerOptions{StopAtTail: true})
+	if s.Scan() || s.Err() != errSegmentHeaderCorrupted {
+		t.Fatalf("expect corrupted header but got %v", s.Err())
+	}
+	s.Close()
+	s = newTestScanner(t, path, 1, ScannerOptions{StopAtTail: true})
+	if !s.Scan() || string(s.Message().Value) != "b" {
+		t.Fatalf("expect b but got %v", s.Err())
+	}
+	s.Close()
+	w = newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "c")
+	closeTestWriter(t, w)
+
+	// the last file is checked before appending
+	corruptHeader(3)
+	if _, err := NewWriter(path); err == nil || !strings.Contains(err.Error(), journalFileName(dirPath, 3)) {
+		t.Fatalf("expect error of the corrupted header but got %v", err)
+	}
+}
@@ -1,10 +1,13 @@
 package sej
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"time"
@@ -13,6 +16,7 @@ import (
 var (
 	errMessageCorrupted   = errors.New("last message of the journal file is courrupted")
 	errJournalFileIsEmpty = errors.New("the journal file is empty")
+	errMessageSkipped     = errors.New("message is skipped by the filter")
 )
 
 // Message in a segmented journal file
@@ -21,9 +25,34 @@ type Message struct {
 	Timestamp time.Time
 	Type      byte
 	Key       []byte
+	Headers   []Header // since format version 2
 	Value     []byte
 }
 
+// Header is a named value of a message, e.g. a trace ID or a content type,
+// kept apart from the value. The names are not necessarily unique.
+type Header struct {
+	Name  string
+	Value []byte
+}
+
+const (
+	// formatV0 is the legacy message format without checksum
+	formatV0 = 0
+	// formatV1 adds a CRC32C checksum over offset, timestamp, type, format, key and value
+	formatV1 = 1
+	// formatV2 adds headers between key and value
+	formatV2 = 2
+	// formatV3 encodes the key size as a uvarint, allowing keys longer than 127 bytes
+	formatV3 = 3
+
+	formatCurrent = formatV3
+	// formatFlag is set in the format byte to distinguish it from the key size of formatV0
+	formatFlag = 0x80
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type readSeekCloser interface {
 	io.Reader
 	io.Seeker
@@ -35,6 +64,7 @@ func (m *Message) IsNull() bool {
 		m.Timestamp.IsZero() &&
 		m.Type == 0 &&
 		m.Key == nil &&
+		m.Headers == nil &&
 		m.Value == nil
 }
 
@@ -44,64 +74,107 @@ func (m *Message) Copy() Message {
 		Timestamp: m.Timestamp,
 		Type:      m.Type,
 		Key:       append([]byte(nil), m.Key...),
+		Headers:   copyHeaders(m.Headers),
 		Value:     append([]byte(nil), m.Value...),
 	}
 }
 
-// WriteMessage writes the message
+func copyHeaders(headers []Header) []Header {
+	if headers == nil {
+		return nil
+	}
+	c := make([]Header, len(headers))
+	for i := range headers {
+		c[i] = Header{Name: headers[i].Name, Value: append([]byte(nil), headers[i].Value...)}
+	}
+	return c
+}
+
+// WriteMessage writes the message in the current format, or in format version 1
+// if it has neither headers nor a key longer than 127 bytes so that it is still
+// readable by older versions
 // buf should be at least 8 bytes and is used to avoid allocation
 func WriteMessage(w io.Writer, buf []byte, m *Message) (int64, error) {
+	if len(m.Headers) == 0 && len(m.Key) <= math.MaxInt8 {
+		return writeMessage(w, buf, m, formatV1)
+	}
+	return writeMessage(w, buf, m, formatCurrent)
+}
+
+func writeMessage(w io.Writer, buf []byte, m *Message, format byte) (int64, error) {
 	cnt := int64(0) // total bytes written
+	cw := crcWriter{w: w}
 
-	n, err := writeUint64(w, buf, m.Offset)
+	n, err := writeUint64(&cw, buf, m.Offset)
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	ts := m.Timestamp
-	var nano int64
-	if ts.IsZero() {
-		nano = math.MinInt64
-	} else {
-		nano = ts.UnixNano()
-	}
-	n, err = writeInt64(w, buf, nano)
+	n, err = writeInt64(&cw, buf, unixNano(m.Timestamp))
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	n, err = writeByte(w, buf, m.Type)
+	n, err = writeByte(&cw, buf, m.Type)
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	n, err = writeInt8(w, buf, int8(len(m.Key)))
+	if format != formatV0 {
+		n, err = writeByte(&cw, buf, formatFlag|format)
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+	}
+
+	if format >= formatV3 {
+		n, err = writeUvarint(&cw, buf, uint64(len(m.Key)))
+	} else {
+		n, err = writeInt8(&cw, buf, int8(len(m.Key)))
+	}
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	n, err = w.Write(m.Key)
+	n, err = cw.Write(m.Key)
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	n, err = writeInt32(w, buf, int32(len(m.Value)))
+	if format >= formatV2 {
+		nn, err := writeHeaders(&cw, buf, m.Headers)
+		cnt += nn
+		if err != nil {
+			return cnt, err
+		}
+	}
+
+	n, err = writeInt32(&cw, buf, int32(len(m.Value)))
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
-	n, err = w.Write(m.Value)
+	n, err = cw.Write(m.Value)
 	cnt += int64(n)
 	if err != nil {
 		return cnt, err
 	}
 
+	if format != formatV0 {
+		n, err = writeUint32(w, cw.crc)
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+	}
+
 	n, err = writeInt32(w, buf, int32(cnt)+4)
 	cnt += int64(n)
 	if err != nil {
@@ -113,67 +186,165 @@ func WriteMessage(w io.Writer, buf []byte, m *Message) (int64, error) {
 
 // ReadFrom reads a message from a io.ReadSeeker.
 // When an error occurs, it will rollback the seeker and then returns the original error.
+// Messages in all the supported formats can be read and checksums are verified
+// when available, returning ErrCRC on mismatch.
+// If the message is the first one of a compressed batch, the whole batch is
+// read and the rest of its messages are dropped, use MessageReader to read them.
+// ErrNoKey is returned for an encrypted message, which can be read by a
+// MessageReader with its key set.
 func (m *Message) ReadFrom(r io.Reader) (n int64, err error) {
-	cnt := int64(0) // total bytes read
+	return m.readFrom(&crcReader{r: r}, false, nil)
+}
 
-	nn, err := readUint64(r, &m.Offset)
-	cnt += int64(nn)
-	if err != nil {
-		return cnt, err
+// readFrom reads a message like ReadFrom from cr, which can be reused for
+// reading the next message. The key and value alias the data of the underlying
+// reader if it is memory-mapped, or reuse the buffers of the previous key and
+// value if reuse is true.
+// The messages of a batch are read from cr.batch after the batch is read with
+// the first one, and 0 bytes are returned for the rest of them.
+// If filter is not nil and returns false for the message with its offset,
+// timestamp, type, key and headers read, the value and checksum are skipped without
+// being read or verified, and errMessageSkipped is returned.
+func (m *Message) readFrom(cr *crcReader, reuse bool, filter func(*Message) bool) (n int64, err error) {
+	if b := cr.batch; b != nil {
+		if b.Len() > 0 {
+			// the buffers aliasing a memory-mapped file must not be reused
+			return 0, b.readMessage(m, reuse && !cr.aliasing(), filter)
+		}
+		b.reset()
 	}
+	cr.crc = 0
+	cr.count = 1
+	cnt := int64(0) // total bytes read
 
-	var unixNano int64
-	nn, err = readInt64(r, &unixNano)
+	b, nn, err := cr.next(8, true)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
 	}
-	if unixNano != math.MinInt64 {
-		m.Timestamp = time.Unix(0, unixNano).UTC()
-	} else {
-		m.Timestamp = time.Time{}
-	}
+	m.Offset = binary.BigEndian.Uint64(b)
 
-	nn, err = readByte(r, &m.Type)
+	b, nn, err = cr.next(8, true)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
 	}
+	m.Timestamp = fromUnixNano(int64(binary.BigEndian.Uint64(b)))
 
-	var keyLen int8
-	nn, err = readInt8(r, &keyLen)
+	// the byte after type is either the format (high bit set) or the key size
+	// of a legacy message
+	b, nn, err = cr.next(2, true)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
 	}
+	m.Type = b[0]
+	format := b[1]
+	var keyLen int
+	if format&formatFlag == 0 {
+		keyLen = int(int8(format))
+		format = formatV0
+	} else {
+		format &^= formatFlag
+		if format == formatBatch || format == formatBatchV1 {
+			if _, nested := cr.r.(*batchReader); nested {
+				return cnt, errMessageCorrupted
+			}
+			cnt, err = cr.readBatch(cnt, m, format)
+			if err != nil {
+				return cnt, err
+			}
+			if cr.records {
+				m.Key, m.Headers, m.Value = nil, nil, nil
+				return cnt, nil
+			}
+			return cnt, cr.batch.readMessage(m, reuse && !cr.aliasing(), filter)
+		}
+		if format > formatCurrent {
+			return cnt, errMessageCorrupted
+		}
+		if format >= formatV3 {
+			var size uint64
+			size, nn, err = cr.uvarint()
+			cnt += int64(nn)
+			if err != nil {
+				return cnt, err
+			}
+			if size > math.MaxInt32 {
+				return cnt, errMessageCorrupted
+			}
+			keyLen = int(size)
+		} else {
+			b, nn, err = cr.next(1, true)
+			cnt += int64(nn)
+			if err != nil {
+				return cnt, err
+			}
+			keyLen = int(int8(b[0]))
+		}
+	}
 	if keyLen < 0 {
 		return cnt, errMessageCorrupted
 	}
 
 	if keyLen > 0 {
-		m.Key = make([]byte, int(keyLen))
-		nn, err = io.ReadFull(r, m.Key)
+		m.Key, nn, err = cr.readBytes(m.Key, keyLen, reuse)
 		cnt += int64(nn)
 		if err != nil {
 			return cnt, err
 		}
-		if nn != int(keyLen) {
+		if nn != keyLen {
 			return cnt, fmt.Errorf("message is truncated at %d", m.Offset)
 		}
+	} else {
+		m.Key = nil
+	}
+
+	if format >= formatV2 {
+		nn64, err := m.readHeaders(cr, reuse)
+		cnt += nn64
+		if err != nil {
+			return cnt, err
+		}
+	} else if reuse {
+		m.Headers = m.Headers[:0]
+	} else {
+		m.Headers = nil
 	}
 
-	var valueLen int32
-	nn, err = readInt32(r, &valueLen)
+	b, nn, err = cr.next(4, true)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
 	}
+	valueLen := int32(binary.BigEndian.Uint32(b))
 	if valueLen < 0 {
 		return cnt, errMessageCorrupted
 	}
 
-	m.Value = make([]byte, int(valueLen))
-	nn, err = io.ReadFull(r, m.Value)
+	if filter != nil && !filter(m) {
+		m.Value = m.Value[:0]
+		skipLen := int(valueLen)
+		if format != formatV0 {
+			skipLen += 4 // crc
+		}
+		nn, err = cr.skip(skipLen)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		b, nn, err = cr.next(4, false)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		if size := int32(binary.BigEndian.Uint32(b)); int64(size) != cnt {
+			return cnt, errMessageCorrupted
+		}
+		return cnt, errMessageSkipped
+	}
+
+	m.Value, nn, err = cr.readBytes(m.Value, int(valueLen), reuse)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
@@ -181,49 +352,282 @@ func (m *Message) ReadFrom(r io.Reader) (n int64, err error) {
 	if nn != int(valueLen) {
 		return cnt, fmt.Errorf("message is truncated at %d", m.Offset)
 	}
+	crc := cr.crc
 
-	var size int32
-	nn, err = readInt32(r, &size)
+	var storedCRC uint32
+	if format != formatV0 {
+		b, nn, err = cr.next(4, false)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		storedCRC = binary.BigEndian.Uint32(b)
+	}
+
+	b, nn, err = cr.next(4, false)
 	cnt += int64(nn)
 	if err != nil {
 		return cnt, err
 	}
-	if int64(size) != cnt {
+	if size := int32(binary.BigEndian.Uint32(b)); int64(size) != cnt {
 		return cnt, errMessageCorrupted
 	}
+	if format != formatV0 && storedCRC != crc {
+		return cnt, ErrCRC
+	}
 
 	return cnt, nil
 }
 
-func readMessageBackward(r io.ReadSeeker) (*Message, error) {
+func writeHeaders(w io.Writer, buf []byte, headers []Header) (int64, error) {
+	cnt := int64(0)
+	n, err := writeUint16(w, buf, uint16(len(headers)))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	for i := range headers {
+		n, err = writeByte(w, buf, byte(len(headers[i].Name)))
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+		n, err = io.WriteString(w, headers[i].Name)
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+		n, err = writeInt32(w, buf, int32(len(headers[i].Value)))
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+		n, err = w.Write(headers[i].Value)
+		cnt += int64(n)
+		if err != nil {
+			return cnt, err
+		}
+	}
+	return cnt, nil
+}
+
+// readHeaders reads the headers of a message since format version 2. The
+// header values are read like the key and value of the message.
+func (m *Message) readHeaders(cr *crcReader, reuse bool) (int64, error) {
+	cnt := int64(0)
+	b, nn, err := cr.next(2, true)
+	cnt += int64(nn)
+	if err != nil {
+		return cnt, err
+	}
+	count := int(binary.BigEndian.Uint16(b))
+	headers := m.Headers[:0]
+	if !reuse {
+		headers = nil
+	}
+	for i := 0; i < count; i++ {
+		var h Header
+		if i < cap(headers) {
+			h = headers[:i+1][i]
+		}
+
+		b, nn, err = cr.next(1, true)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		nameLen := int(b[0])
+		name, nn, err := cr.readBytes(nil, nameLen, false)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		if nn != nameLen {
+			return cnt, fmt.Errorf("message is truncated at %d", m.Offset)
+		}
+		if h.Name != string(name) {
+			h.Name = string(name)
+		}
+
+		b, nn, err = cr.next(4, true)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		valueLen := int32(binary.BigEndian.Uint32(b))
+		if valueLen < 0 {
+			return cnt, errMessageCorrupted
+		}
+		h.Value, nn, err = cr.readBytes(h.Value, int(valueLen), reuse)
+		cnt += int64(nn)
+		if err != nil {
+			return cnt, err
+		}
+		if nn != int(valueLen) {
+			return cnt, fmt.Errorf("message is truncated at %d", m.Offset)
+		}
+		headers = append(headers, h)
+	}
+	m.Headers = headers
+	return cnt, nil
+}
+
+// unixNano returns the Unix time in nanoseconds or math.MinInt64 if t is zero
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano returns the UTC time of the Unix time in nanoseconds, or the
+// zero time for math.MinInt64
+func fromUnixNano(ns int64) time.Time {
+	if ns == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// seekRecordBackward moves r to the beginning of the message or batch before
+// its position with the size at the end of it
+func seekRecordBackward(r io.ReadSeeker) error {
 	var size int32
 	if _, err := r.Seek(-4, os.SEEK_CUR); err != nil {
-		return nil, err
+		return err
 	}
 	if _, err := readInt32(r, &size); err != nil {
-		return nil, err
+		return err
 	}
-	if _, err := r.Seek(-int64(size), os.SEEK_CUR); err != nil {
+	_, err := r.Seek(-int64(size), os.SEEK_CUR)
+	return err
+}
+
+func readMessageBackward(r io.ReadSeeker) (*Message, error) {
+	if err := seekRecordBackward(r); err != nil {
 		return nil, err
 	}
+	// read through a batch for its last message
+	cr := crcReader{r: r}
 	var msg Message
-	_, err := msg.ReadFrom(r)
-	return &msg, err
+	if _, err := msg.readFrom(&cr, false, nil); err != nil {
+		return &msg, err
+	}
+	for cr.batch != nil && cr.batch.Len() > 0 {
+		if _, err := msg.readFrom(&cr, false, nil); err != nil {
+			return &msg, err
+		}
+	}
+	return &msg, nil
 }
 
-func writeInt8(w io.Writer, buf []byte, i int8) (int, error) {
-	buf[0] = byte(i)
-	return w.Write(buf[:1])
+// readRecordBackward reads the message or batch before the position of r as
+// a record like crcReader.readRecord
+func readRecordBackward(r io.ReadSeeker) (*Message, uint64, error) {
+	if err := seekRecordBackward(r); err != nil {
+		return nil, 0, err
+	}
+	var msg Message
+	_, last, err := (&crcReader{r: r}).readRecord(&msg)
+	return &msg, last, err
 }
 
-func readInt8(r io.Reader, i *int8) (int, error) {
-	var b [1]byte
-	n, err := io.ReadFull(r, b[:])
-	if err != nil {
-		return n, err
+// crcWriter calculates the CRC32C checksum of the bytes written through it
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (w *crcWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.crc = crc32.Update(w.crc, crcTable, p[:n])
+	return n, err
+}
+
+// crcReader calculates the CRC32C checksum of the bytes read through it
+type crcReader struct {
+	r       io.Reader
+	crc     uint32
+	buf     [8]byte
+	batch   *batchReader // the batch being read, allocated for the first batch
+	aead    cipher.AEAD  // decrypts encrypted batches, nil without a key
+	records bool         // reads batches as records, see readRecord
+	count   int          // the number of messages in the last record read
+}
+
+// next reads n (at most 8) bytes into the internal buffer, the checksum is
+// updated only if checked is true
+func (r *crcReader) next(n int, checked bool) ([]byte, int, error) {
+	var nn int
+	var err error
+	if checked {
+		nn, err = io.ReadFull(r, r.buf[:n])
+	} else {
+		nn, err = io.ReadFull(r.r, r.buf[:n])
 	}
-	*i = int8(b[0])
-	return n, nil
+	return r.buf[:nn], nn, err
+}
+
+// readBytes reads n bytes into buf if reuse is true and buf is large enough,
+// or into a new slice otherwise. If the underlying reader is memory-mapped,
+// the returned slice aliases the mapped data instead.
+func (r *crcReader) readBytes(buf []byte, n int, reuse bool) ([]byte, int, error) {
+	if m, ok := r.r.(aliasReader); ok {
+		b, err := m.alias(n)
+		r.crc = crc32.Update(r.crc, crcTable, b)
+		return b, len(b), err
+	}
+	if reuse && cap(buf) >= n {
+		buf = buf[:n]
+	} else {
+		buf = make([]byte, n)
+	}
+	nn, err := io.ReadFull(r, buf)
+	return buf, nn, err
+}
+
+// uvarint reads an unsigned varint of at most binary.MaxVarintLen32 bytes
+func (r *crcReader) uvarint() (uint64, int, error) {
+	var x uint64
+	for i := 0; i < binary.MaxVarintLen32; i++ {
+		b, nn, err := r.next(1, true)
+		if err != nil {
+			return 0, i + nn, err
+		}
+		x |= uint64(b[0]&0x7f) << (7 * uint(i))
+		if b[0] < 0x80 {
+			return x, i + 1, nil
+		}
+	}
+	return 0, binary.MaxVarintLen32, errMessageCorrupted
+}
+
+// skipReader is implemented by readers that can skip data without reading it
+type skipReader interface {
+	// skip advances the reader by n bytes, or to the end with io.EOF or
+	// io.ErrUnexpectedEOF if there are fewer bytes
+	skip(n int) (int, error)
+}
+
+// skip advances n bytes without updating the checksum, and without reading
+// them if the underlying reader is a skipReader
+func (r *crcReader) skip(n int) (int, error) {
+	if s, ok := r.r.(skipReader); ok {
+		return s.skip(n)
+	}
+	nn, err := io.CopyN(ioutil.Discard, r.r, int64(n))
+	return int(nn), err
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc = crc32.Update(r.crc, crcTable, p[:n])
+	return n, err
+}
+
+func writeInt8(w io.Writer, buf []byte, i int8) (int, error) {
+	buf[0] = byte(i)
+	return w.Write(buf[:1])
 }
 
 func writeByte(w io.Writer, buf []byte, i byte) (int, error) {
@@ -231,14 +635,15 @@ func writeByte(w io.Writer, buf []byte, i byte) (int, error) {
 	return w.Write(buf[:1])
 }
 
-func readByte(r io.Reader, i *byte) (int, error) {
-	var b [1]byte
-	n, err := io.ReadFull(r, b[:])
-	if err != nil {
-		return n, err
-	}
-	*i = b[0]
-	return n, nil
+// writeUvarint writes i as an unsigned varint, buf should be large enough for it
+func writeUvarint(w io.Writer, buf []byte, i uint64) (int, error) {
+	n := binary.PutUvarint(buf, i)
+	return w.Write(buf[:n])
+}
+
+func writeUint16(w io.Writer, buf []byte, i uint16) (int, error) {
+	binary.BigEndian.PutUint16(buf, i)
+	return w.Write(buf[:2])
 }
 
 func writeInt64(w io.Writer, buf []byte, i int64) (int, error) {
@@ -246,17 +651,6 @@ func writeInt64(w io.Writer, buf []byte, i int64) (int, error) {
 	return w.Write(buf[:8])
 }
 
-func readInt64(r io.Reader, i *int64) (int, error) {
-	var b [8]byte
-	n, err := io.ReadFull(r, b[:])
-	if err != nil {
-		return n, err
-	}
-	*i = int64(b[0])<<56 | int64(b[1])<<48 | int64(b[2])<<40 | int64(b[3])<<32 |
-		int64(b[4])<<24 | int64(b[5])<<16 | int64(b[6])<<8 | int64(b[7])
-	return n, nil
-}
-
 func writeUint64(w io.Writer, buf []byte, i uint64) (int, error) {
 	binary.BigEndian.PutUint64(buf, i)
 	return w.Write(buf[:8])
@@ -292,87 +686,114 @@ func writeUint32(w io.Writer, i uint32) (int, error) {
 	return w.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
 }
 
-func readUint32(r io.Reader, i *uint32) (int, error) {
-	var b [4]byte
-	n, err := io.ReadFull(r, b[:])
-	if err != nil {
-		return n, err
-	}
-	*i = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
-	return n, nil
-}
-
 func (journalFile *JournalFile) FirstMessage() (*Message, error) {
-	file, err := os.Open(journalFile.FileName)
+	file, _, err := openSegment(journalFile.FileName)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	fileStat, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
-	if fileStat.Size() == 0 {
-		return nil, errJournalFileIsEmpty
-	}
 	var msg Message
 	if _, err := msg.ReadFrom(file); err != nil {
+		if err == io.EOF {
+			return nil, errJournalFileIsEmpty
+		}
 		return nil, err
 	}
 	return &msg, nil
 }
 
 func (journalFile *JournalFile) LastMessage() (*Message, error) {
-	file, err := os.Open(journalFile.FileName)
+	file, err := journalFile.openEnd()
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	fileSize, err := file.Seek(0, os.SEEK_END)
+	msg, err := readMessageBackward(file)
+	if err != nil {
+		return nil, errMessageCorrupted
+	}
+	return msg, nil
+}
+
+// lastRecord returns the last message or batch of the journal file as a record
+// like crcReader.readRecord, and the offset of the last message in it, so that
+// an encrypted journal file can be read without the key
+func (journalFile *JournalFile) lastRecord() (*Message, uint64, error) {
+	file, err := journalFile.openEnd()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	msg, last, err := readRecordBackward(file)
 	if err != nil {
+		return nil, 0, errMessageCorrupted
+	}
+	return msg, last, nil
+}
+
+// openEnd opens the journal file and moves to its end, or returns
+// errJournalFileIsEmpty if it has no messages
+func (journalFile *JournalFile) openEnd() (*os.File, error) {
+	file, _, err := openSegment(journalFile.FileName)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || err == errSegmentHeaderCorrupted {
+			return nil, errMessageCorrupted
+		}
 		return nil, err
 	}
-	if fileSize == 0 {
-		return nil, errJournalFileIsEmpty
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
-	msg, err := readMessageBackward(file)
+	fileSize, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, errMessageCorrupted
+		file.Close()
+		return nil, err
 	}
-	return msg, nil
+	if fileSize == start {
+		file.Close()
+		return nil, errJournalFileIsEmpty
+	}
+	return file, nil
 }
 
 // LatestOffset returns the offset after the last message in a journal file
 func (journalFile *JournalFile) LastOffset() (uint64, error) {
-	msg, err := journalFile.LastMessage()
+	_, last, err := journalFile.lastRecord()
 	if err != nil {
 		if err == errJournalFileIsEmpty {
 			return journalFile.FirstOffset, nil
 		}
 		return 0, err
 	}
-	return msg.Offset + 1, nil
+	return last + 1, nil
 }
 
+// LastReadableOffset returns the offset after the last complete message in a
+// journal file, like LastOffset but ignoring an incomplete or corrupted
+// message at the end
 func (journalFile *JournalFile) LastReadableOffset() (uint64, error) {
 	offset, err := journalFile.LastOffset()
 	if err == nil {
 		return offset, nil
 	}
 	oriErr := err
+	offset = journalFile.FirstOffset
 
-	f, err := os.Open(journalFile.FileName)
+	f, _, err := openSegment(journalFile.FileName)
 	if err != nil {
 		return 0, oriErr
 	}
 	defer f.Close()
+	cr := crcReader{r: f}
 	var msg Message
 	for {
-		_, err := msg.ReadFrom(f)
+		_, last, err := cr.readRecord(&msg)
 		if err != nil {
 			break
 		}
-		offset = msg.Offset
+		offset = last + 1
 	}
 	return offset, nil
 }
@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	metaSize = 26 // message size excluding the value (assuming key is zero size)
+	metaSize       = 31 // message size excluding the value (assuming key is zero size)
+	legacyMetaSize = 26 // metaSize of formatV0
+	headerSize     = segmentHeaderFixedSize + len(testWriterID)
 )
 
 func TestMarshalUnmarshal(t *testing.T) {
@@ -39,6 +41,100 @@ func TestMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalHeaders(t *testing.T) {
+	msg := Message{
+		Offset:    42,
+		Timestamp: time.Now().UTC().Truncate(time.Nanosecond),
+		Type:      43,
+		Key:       []byte("a"),
+		Headers: []Header{
+			{Name: "trace-id", Value: []byte("123")},
+			{Name: "content-type", Value: []byte("application/json")},
+			{Name: "trace-id", Value: []byte{}},
+		},
+		Value: []byte("b"),
+	}
+	var buf bytes.Buffer
+	n1, err := WriteMessage(&buf, make([]byte, 8), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := buf.Bytes()[17]; format != formatFlag|formatCurrent {
+		t.Fatalf("expect format %x but got %x", formatFlag|formatCurrent, format)
+	}
+	var result Message
+	n2, err := result.ReadFrom(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != n2 {
+		t.Fatal("size mismatch")
+	}
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("expect\n%v\ngot\n%v", msg, result)
+	}
+
+	// truncated within the headers
+	for cut := 1; cut < int(n1); cut++ {
+		var result Message
+		n, err := result.ReadFrom(bytes.NewReader(buf.Bytes()[:cut]))
+		if err == nil {
+			t.Fatalf("cut=%d: expect error but got nil", cut)
+		}
+		if n != int64(cut) {
+			t.Fatalf("cut=%d: expect %d bytes read but got %d", cut, cut, n)
+		}
+	}
+
+	// a message without headers read with the buffers of the previous one
+	var noHeaders bytes.Buffer
+	if _, err := WriteMessage(&noHeaders, make([]byte, 8), &Message{Value: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := result.readFrom(&crcReader{r: &noHeaders}, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Headers) != 0 || string(result.Value) != "c" {
+		t.Fatalf("expect no headers but got %v", result.Headers)
+	}
+}
+
+func TestMarshalUnmarshalLongKey(t *testing.T) {
+	msg := Message{
+		Offset:    42,
+		Timestamp: time.Now().UTC().Truncate(time.Nanosecond),
+		Type:      43,
+		Key:       bytes.Repeat([]byte("k"), 1000),
+		Value:     []byte("b"),
+	}
+	var buf bytes.Buffer
+	n1, err := WriteMessage(&buf, make([]byte, 8), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := buf.Bytes()[17]; format != formatFlag|formatV3 {
+		t.Fatalf("expect format %x but got %x", formatFlag|formatV3, format)
+	}
+	var result Message
+	n2, err := result.ReadFrom(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != n2 {
+		t.Fatal("size mismatch")
+	}
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("expect\n%v\ngot\n%v", msg, result)
+	}
+
+	// the key size is never longer than binary.MaxVarintLen32
+	corrupted := append([]byte(nil), buf.Bytes()[:18]...)
+	corrupted = append(corrupted, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+	if _, err := result.ReadFrom(bytes.NewReader(corrupted)); err != errMessageCorrupted {
+		t.Fatalf("expect errMessageCorrupted but got %v", err)
+	}
+}
+
 func TestReadTruncatedMessage(t *testing.T) {
 	for cut := 20; cut >= 1; cut-- {
 		path := newTestPath(t)
@@ -54,6 +150,9 @@ func TestReadTruncatedMessage(t *testing.T) {
 			t.Fatal(err)
 		}
 		defer f.Close()
+		if _, err := ReadSegmentHeader(f); err != nil {
+			t.Fatal(err)
+		}
 		var msg Message
 		n, err := msg.ReadFrom(f)
 		if err == nil {
@@ -65,8 +164,55 @@ func TestReadTruncatedMessage(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if fileOffset != 0 {
-			t.Fatalf("cut=%d: expect offset 0 after failed reading, but got %d", cut, fileOffset)
+		if fileOffset != int64(headerSize) {
+			t.Fatalf("cut=%d: expect offset %d after failed reading, but got %d", cut, headerSize, fileOffset)
 		}
 	}
 }
+
+func TestReadLegacyMessage(t *testing.T) {
+	msg := Message{
+		Offset:    42,
+		Timestamp: time.Now().UTC().Truncate(time.Nanosecond),
+		Type:      43,
+		Key:       []byte("a"),
+		Value:     []byte("b"),
+	}
+	var buf bytes.Buffer
+	n1, err := writeMessage(&buf, make([]byte, 8), &msg, formatV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != legacyMetaSize+2 {
+		t.Fatalf("expect legacy message size %d but got %d", legacyMetaSize+2, n1)
+	}
+	var result Message
+	n2, err := result.ReadFrom(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != n2 {
+		t.Fatal("size mismatch")
+	}
+	if !reflect.DeepEqual(result, msg) {
+		t.Fatalf("expect\n%v\ngot\n%v", msg, result)
+	}
+}
+
+func TestReadCRCMismatch(t *testing.T) {
+	msg := Message{
+		Offset: 42,
+		Key:    []byte("a"),
+		Value:  []byte("bcd"),
+	}
+	var buf bytes.Buffer
+	if _, err := WriteMessage(&buf, make([]byte, 8), &msg); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(data)-10] ^= 0x01 // flip a bit in the value
+	var result Message
+	if _, err := result.ReadFrom(bytes.NewReader(data)); err != ErrCRC {
+		t.Fatalf("expect ErrCRC but got %v", err)
+	}
+}
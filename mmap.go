@@ -0,0 +1,99 @@
+package sej
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// aliasReader is implemented by readers that can return their data without copying
+type aliasReader interface {
+	// alias returns the next n bytes and advances the reader
+	alias(n int) ([]byte, error)
+}
+
+// mappedFile reads a closed journal file from memory-mapped data, so that the
+// key and value of the messages read from it alias the mapped data
+type mappedFile struct {
+	name string
+	data []byte
+	pos  int64
+}
+
+func openMappedFile(name string) (*mappedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mappedFile{name: name}
+	if stat.Size() > 0 {
+		m.data, err = syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *mappedFile) Name() string { return m.name }
+
+func (m *mappedFile) Watch() chan bool { return nil }
+
+func (m *mappedFile) Read(p []byte) (int, error) {
+	if m.pos >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.pos:])
+	m.pos += int64(n)
+	return n, nil
+}
+
+func (m *mappedFile) alias(n int) ([]byte, error) {
+	rest := int64(len(m.data)) - m.pos
+	if int64(n) > rest {
+		b := m.data[m.pos:]
+		m.pos = int64(len(m.data))
+		if rest == 0 {
+			return b, io.EOF
+		}
+		return b, io.ErrUnexpectedEOF
+	}
+	b := m.data[m.pos : m.pos+int64(n) : m.pos+int64(n)]
+	m.pos += int64(n)
+	return b, nil
+}
+
+func (m *mappedFile) skip(n int) (int, error) {
+	b, err := m.alias(n)
+	return len(b), err
+}
+
+func (m *mappedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	if offset < 0 {
+		return m.pos, errors.New("seek before the beginning of the file")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// Close unmaps the data, which must not be accessed afterwards
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,48 @@
+package sej
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestScanZeroCopy(t *testing.T) {
+	path := newTestPath(t)
+	// 10 messages per segment
+	w := newTestWriter(t, path, headerSize+10*(metaSize+2))
+	var values []string
+	for i := 0; i < 30; i++ {
+		values = append(values, strconv.Itoa(10+i))
+	}
+	writeTestMessages(t, w, values...)
+	flushTestWriter(t, w)
+	defer closeTestWriter(t, w)
+
+	s := newTestScanner(t, path, 0, ScannerOptions{ZeroCopy: true})
+	defer s.Close()
+	if _, ok := s.file.(*mappedFile); !ok {
+		t.Fatalf("expect closed segment mapped but got %T", s.file)
+	}
+	for i, value := range values {
+		if !s.Scan() {
+			t.Fatal(s.Err())
+		}
+		if msg := string(s.Message().Value); msg != value {
+			t.Fatalf("%d: expect %s but got %s", i, value, msg)
+		}
+	}
+
+	for _, offset := range []uint64{0, 20} {
+		if err := s.Seek(offset); err != nil {
+			t.Fatal(err)
+		}
+		s.Scan() // allocate the buffers to be reused
+		allocs := testing.AllocsPerRun(4, func() {
+			if !s.Scan() {
+				t.Fatal(s.Err())
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("offset %d: expect no allocation but got %v", offset, allocs)
+		}
+	}
+}
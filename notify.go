@@ -0,0 +1,88 @@
+package sej
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// localJournals tracks the journal directories opened in this process, so
+// that a writer can wake up the scanners of the same directory without the
+// round trip through the kernel
+var localJournals = &localRegistry{journals: make(map[string]*localJournal)}
+
+type localRegistry struct {
+	journals map[string]*localJournal
+	mu       sync.Mutex
+}
+
+// localJournal broadcasts the changes made by the writer of a journal
+// directory to the scanners in the same process
+type localJournal struct {
+	name    string
+	refs    int
+	writer  *Writer
+	changed chan struct{}
+	waiting bool
+	mu      sync.Mutex
+}
+
+// acquire returns the local journal of dir, which must be released when no
+// longer used
+func (r *localRegistry) acquire(dir string) *localJournal {
+	name, err := filepath.Abs(dir)
+	if err != nil {
+		name = filepath.Clean(dir)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j := r.journals[name]
+	if j == nil {
+		j = &localJournal{name: name, changed: make(chan struct{})}
+		r.journals[name] = j
+	}
+	j.refs++
+	return j
+}
+
+func (r *localRegistry) release(j *localJournal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j.refs--
+	if j.refs == 0 {
+		delete(r.journals, j.name)
+	}
+}
+
+// Watch returns a channel closed at the next change
+func (j *localJournal) Watch() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.waiting = true
+	return j.changed
+}
+
+// Broadcast wakes up all the scanners waiting for a change
+func (j *localJournal) Broadcast() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.waiting {
+		// avoid allocating a new channel on every append if nobody waits
+		return
+	}
+	close(j.changed)
+	j.changed = make(chan struct{})
+	j.waiting = false
+}
+
+func (j *localJournal) setWriter(w *Writer) {
+	j.mu.Lock()
+	j.writer = w
+	j.mu.Unlock()
+}
+
+// Writer returns the live writer of the journal directory in this process or nil
+func (j *localJournal) Writer() *Writer {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.writer
+}
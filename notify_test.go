@@ -0,0 +1,44 @@
+package sej
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanReadUnflushed(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: 100 * time.Millisecond})
+	writeTestMessages(t, w, "a")
+	if s.Scan() {
+		t.Fatal("expect unflushed message invisible")
+	}
+	if s.Err() != ErrTimeout {
+		t.Fatalf("expect timeout but got %v", s.Err())
+	}
+	s.Close()
+
+	s = newTestScanner(t, path, 0, ScannerOptions{Timeout: 10 * time.Second, ReadUnflushed: true})
+	defer s.Close()
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if msg := string(s.Message().Value); msg != "a" {
+		t.Fatalf("expect a but got %s", msg)
+	}
+
+	// woken up by the append of the writer in the same process
+	time.AfterFunc(10*time.Millisecond, func() { w.Append(&Message{Value: []byte("b")}) })
+	start := time.Now()
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if msg := string(s.Message().Value); msg != "b" {
+		t.Fatalf("expect b but got %s", msg)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect woken up immediately but took %v", elapsed)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 )
 
 // Offset is used to manage a disk-persisted offset
@@ -134,6 +135,28 @@ func (o *Offset) Close() error {
 	return o.dir.Close()
 }
 
+// ReadOffsets reads all the offsets persisted in dir/ofs, keyed by the file names
+func ReadOffsets(dir string) (map[string]uint64, error) {
+	offsets := make(map[string]uint64)
+	ofsFiles, err := filepath.Glob(path.Join(OffsetDirPath(dir), "*.ofs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, ofsFile := range ofsFiles {
+		f, err := os.Open(ofsFile)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := ReadOffset(f)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		offsets[ofsFile] = offset
+	}
+	return offsets, nil
+}
+
 func OffsetDirPath(dir string) string {
 	return path.Join(dir, "ofs")
 }
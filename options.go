@@ -0,0 +1,186 @@
+package sej
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultSegmentSize       = 1024 * 1024 * 1024
+	defaultWriterBufferSize  = 4096
+	defaultScannerBufferSize = 65536
+	defaultScannerTimeout    = time.Second
+	defaultBatchSize         = 65536
+)
+
+// WriterOptions is the configuration of a Writer. Zero values mean defaults.
+type WriterOptions struct {
+	SegmentSize   int        // minimal size of a segment file before rolling, default 1 GiB
+	WriterID      string     // written into the header of each new segment file, default hostname:pid
+	IndexInterval int        // minimal bytes between two index entries, default 4096
+	Durability    Durability // when to sync appended messages, default SyncNone
+	BufferSize    int        // size of the write buffer, default 4096
+
+	// SegmentMaxAge is the maximal age of a segment file, after which the next
+	// message is appended to a new segment file, 0 means no limit
+	SegmentMaxAge time.Duration
+	// SegmentAligned aligns the rolling to the multiples of SegmentMaxAge in UTC,
+	// e.g. hourly rolling at the top of each hour when SegmentMaxAge is an hour
+	SegmentAligned bool
+
+	// Codec compresses the appended messages in batches if it is not CodecNone.
+	// The offsets are still assigned to each message.
+	Codec Codec
+	// BatchSize is the minimal size of the encoded messages of a batch before it
+	// is compressed, default 65536
+	BatchSize int
+	// BatchLinger is the maximal time the messages wait in an incomplete batch
+	// before it is compressed and flushed, 0 means until it is flushed otherwise
+	BatchLinger time.Duration
+
+	// Cipher encrypts the messages of each new segment file if it is not
+	// CipherNone, each batch or each message without Codec. The number of
+	// the messages or batches encrypted with a key is not counted, so
+	// CipherXChaCha20Poly1305 is the only cipher safe for long-lived keys.
+	Cipher Cipher
+	// KeyProvider provides the current key for each new segment file and the
+	// key of the last segment file to be appended, required with Cipher
+	KeyProvider KeyProvider
+}
+
+// validate returns an OptionError for the first invalid option, or the
+// options with the defaults filled in
+func (o WriterOptions) validate() (WriterOptions, error) {
+	switch {
+	case o.SegmentSize < 0:
+		return o, &OptionError{Option: "SegmentSize", Value: o.SegmentSize}
+	case len(o.WriterID) > math.MaxUint8:
+		return o, &OptionError{Option: "WriterID", Value: o.WriterID}
+	case o.IndexInterval < 0:
+		return o, &OptionError{Option: "IndexInterval", Value: o.IndexInterval}
+	case o.BufferSize < 0:
+		return o, &OptionError{Option: "BufferSize", Value: o.BufferSize}
+	case o.SegmentMaxAge < 0:
+		return o, &OptionError{Option: "SegmentMaxAge", Value: o.SegmentMaxAge}
+	case o.SegmentAligned && o.SegmentMaxAge == 0:
+		return o, &OptionError{Option: "SegmentAligned", Value: "no SegmentMaxAge"}
+	case o.Codec > CodecZstd:
+		return o, &OptionError{Option: "Codec", Value: o.Codec}
+	case o.BatchSize < 0:
+		return o, &OptionError{Option: "BatchSize", Value: o.BatchSize}
+	case o.BatchLinger < 0:
+		return o, &OptionError{Option: "BatchLinger", Value: o.BatchLinger}
+	case o.Cipher > CipherXChaCha20Poly1305:
+		return o, &OptionError{Option: "Cipher", Value: o.Cipher}
+	case o.Cipher != CipherNone && o.KeyProvider == nil:
+		return o, &OptionError{Option: "Cipher", Value: "no KeyProvider"}
+	}
+	switch o.Durability.Mode {
+	case SyncNone, SyncGroupCommit:
+	case SyncInterval:
+		if o.Durability.Interval <= 0 {
+			return o, &OptionError{Option: "Durability.Interval", Value: o.Durability.Interval}
+		}
+	case SyncBytes:
+		if o.Durability.Bytes <= 0 {
+			return o, &OptionError{Option: "Durability.Bytes", Value: o.Durability.Bytes}
+		}
+	default:
+		return o, &OptionError{Option: "Durability.Mode", Value: o.Durability.Mode}
+	}
+
+	if o.SegmentSize == 0 {
+		o.SegmentSize = defaultSegmentSize
+	}
+	if o.WriterID == "" {
+		o.WriterID = defaultWriterID()
+	}
+	if o.IndexInterval == 0 {
+		o.IndexInterval = defaultIndexInterval
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = defaultWriterBufferSize
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	return o, nil
+}
+
+// ScannerOptions is the configuration of a Scanner. Zero values mean defaults.
+type ScannerOptions struct {
+	// Timeout is the read timeout when no data arrived, after which Scan
+	// returns false with ErrTimeout, default 1 second, negative for no timeout
+	Timeout time.Duration
+	// BufferSize is the size of the read buffer of the last journal file and
+	// closed journal files not memory-mapped, default 65536
+	BufferSize int
+
+	// ReadUnflushed makes the scanner flush the writer of the same process
+	// when reaching the end, so that the buffered messages can be read
+	ReadUnflushed bool
+
+	// ZeroCopy makes the key, header values and value of Message valid only
+	// until the next Scan, aliasing closed journal files mapped into memory,
+	// or reusing the buffers of the previous message when reading the last
+	// journal file
+	ZeroCopy bool
+
+	// ChangeDetection is the strategy of detecting new messages, default
+	// DefaultChangeDetection
+	ChangeDetection ChangeDetection
+	// PollInterval is the interval of checking for new messages when polling,
+	// default DefaultPollInterval
+	PollInterval time.Duration
+
+	// Filter makes Scan skip the messages for which it returns false. It is
+	// called with the offset, timestamp, type, key and headers of a message
+	// before the value is read, so that the value of a skipped message is
+	// neither read nor verified.
+	Filter func(*Message) bool
+
+	// EndOffset makes Scan return false with io.EOF instead of reading the
+	// message at or beyond the offset if it is not zero
+	EndOffset uint64
+	// EndTime makes Scan return false with io.EOF instead of reading the first
+	// message with a timestamp no earlier than EndTime if it is not zero.
+	// Messages after it are not read even if they are earlier than EndTime.
+	EndTime time.Time
+	// StopAtTail makes Scan return false with io.EOF instead of waiting when
+	// reaching the end of the journal
+	StopAtTail bool
+
+	// KeyProvider provides the keys of encrypted segment files by the key IDs
+	// in their headers, without which Scan fails with ErrNoKey
+	KeyProvider KeyProvider
+}
+
+// validate returns an OptionError for the first invalid option, or the
+// options with the defaults filled in
+func (o ScannerOptions) validate() (ScannerOptions, error) {
+	switch {
+	case o.BufferSize < 0:
+		return o, &OptionError{Option: "BufferSize", Value: o.BufferSize}
+	case o.ChangeDetection < DetectAuto || o.ChangeDetection > DetectHybrid:
+		return o, &OptionError{Option: "ChangeDetection", Value: o.ChangeDetection}
+	case o.PollInterval < 0:
+		return o, &OptionError{Option: "PollInterval", Value: o.PollInterval}
+	}
+
+	switch {
+	case o.Timeout == 0:
+		o.Timeout = defaultScannerTimeout
+	case o.Timeout < 0:
+		o.Timeout = 0
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = defaultScannerBufferSize
+	}
+	if o.ChangeDetection == DetectAuto {
+		o.ChangeDetection = DefaultChangeDetection
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = DefaultPollInterval
+	}
+	return o, nil
+}
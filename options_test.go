@@ -0,0 +1,82 @@
+package sej
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterOptionsValidate(t *testing.T) {
+	path := newTestPath(t)
+	for _, testcase := range []struct {
+		opts   WriterOptions
+		option string
+	}{
+		{WriterOptions{SegmentSize: -1}, "SegmentSize"},
+		{WriterOptions{WriterID: strings.Repeat("x", 256)}, "WriterID"},
+		{WriterOptions{IndexInterval: -1}, "IndexInterval"},
+		{WriterOptions{BufferSize: -1}, "BufferSize"},
+		{WriterOptions{SegmentMaxAge: -time.Hour}, "SegmentMaxAge"},
+		{WriterOptions{SegmentAligned: true}, "SegmentAligned"},
+		{WriterOptions{Durability: Durability{Mode: SyncInterval}}, "Durability.Interval"},
+		{WriterOptions{Durability: Durability{Mode: SyncBytes}}, "Durability.Bytes"},
+		{WriterOptions{Durability: Durability{Mode: 100}}, "Durability.Mode"},
+		{WriterOptions{Codec: 100}, "Codec"},
+		{WriterOptions{BatchSize: -1}, "BatchSize"},
+		{WriterOptions{BatchLinger: -time.Second}, "BatchLinger"},
+		{WriterOptions{Cipher: 100, KeyProvider: testKeys("k1")}, "Cipher"},
+		{WriterOptions{Cipher: CipherAESGCM}, "Cipher"},
+	} {
+		_, err := NewWriterOptions(path, testcase.opts)
+		if e, ok := err.(*OptionError); !ok || e.Option != testcase.option {
+			t.Fatalf("expect invalid %s but got %v", testcase.option, err)
+		}
+	}
+}
+
+func TestScannerOptionsValidate(t *testing.T) {
+	path := newTestPath(t)
+	for _, testcase := range []struct {
+		opts   ScannerOptions
+		option string
+	}{
+		{ScannerOptions{BufferSize: -1}, "BufferSize"},
+		{ScannerOptions{ChangeDetection: 100}, "ChangeDetection"},
+		{ScannerOptions{PollInterval: -time.Second}, "PollInterval"},
+	} {
+		_, err := NewScannerOptions(context.Background(), path, 0, testcase.opts)
+		if e, ok := err.(*OptionError); !ok || e.Option != testcase.option {
+			t.Fatalf("expect invalid %s but got %v", testcase.option, err)
+		}
+	}
+}
+
+func TestWriterBufferSize(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{BufferSize: 1 << 16})
+	defer closeTestWriter(t, w)
+
+	file := journalFileName(JournalDirPath(path), 0)
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 10; i++ {
+		writeTestMessages(t, w, value)
+	}
+	if size := fileSize(t, file); size != 0 {
+		t.Fatalf("expect nothing flushed but got %d bytes", size)
+	}
+	flushTestWriter(t, w)
+	if size, expected := fileSize(t, file), int64(headerSize+10*(metaSize+1000)); size != expected {
+		t.Fatalf("expect %d bytes flushed but got %d", expected, size)
+	}
+
+	s := newTestScanner(t, path, 0, ScannerOptions{BufferSize: 1 << 16, StopAtTail: true})
+	defer s.Close()
+	n := 0
+	for s.Scan() {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("expect 10 messages but got %d", n)
+	}
+}
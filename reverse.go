@@ -0,0 +1,231 @@
+package sej
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// ReverseScanner reads messages from segmented journal files backward, from
+// the newest to the oldest, with the size at the end of each message. Unlike
+// Scanner, it does not wait for new messages and stops at the first message.
+type ReverseScanner struct {
+	offset    uint64 // the messages before offset are to be scanned
+	files     JournalFiles
+	fileIndex int
+	file      *os.File
+	header    *SegmentHeader
+	start     int64 // the position of the first message in the file
+	pos       int64 // the position after the next message to be scanned
+	message   Message
+	batch     []Message // the messages of a batch before pos to be scanned
+	keys      KeyProvider
+	aead      cipher.AEAD // decrypts the messages of the current file
+	buf       []byte
+	err       error
+}
+
+// NewReverseScanner creates a reverse scanner for reading dir/jnl backward
+// starting from the message before offset. If offset is beyond the last message,
+// e.g. math.MaxUint64, it starts from the last message.
+func NewReverseScanner(dir string, offset uint64) (*ReverseScanner, error) {
+	return NewReverseScannerKeys(dir, offset, nil)
+}
+
+// NewReverseScannerKeys creates a reverse scanner like NewReverseScanner,
+// decrypting the messages of encrypted segment files with the keys
+func NewReverseScannerKeys(dir string, offset uint64, keys KeyProvider) (*ReverseScanner, error) {
+	journalDir, err := OpenJournalDir(JournalDirPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	r := &ReverseScanner{files: journalDir.Files, keys: keys, buf: make([]byte, 4)}
+	journalFile, err := journalDir.find(offset)
+	if err != nil {
+		return nil, err
+	}
+	for r.fileIndex = range r.files {
+		if r.files[r.fileIndex].FirstOffset == journalFile.FirstOffset {
+			break
+		}
+	}
+	if err := r.openFile(); err != nil {
+		return nil, err
+	}
+	if err := r.seekEnd(offset); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// seekEnd moves the position after the last complete message before offset in
+// the current file, with the offset index to skip the messages before it
+func (r *ReverseScanner) seekEnd(offset uint64) error {
+	journalFile := &r.files[r.fileIndex]
+	closed := r.fileIndex < len(r.files)-1
+	if entry, ok, err := journalFile.searchIndex(offset, closed); err == nil && ok && entry.Position >= r.start {
+		valid, err := r.scanEnd(entry.Position, entry.Offset, offset, true)
+		if err != nil || valid {
+			return err
+		}
+		// the index is stale, e.g. the journal has been truncated
+	}
+	_, err := r.scanEnd(r.start, journalFile.FirstOffset, offset, false)
+	return err
+}
+
+// scanEnd reads the current file from pos, where the message at firstOffset is
+// expected to be, until the message at offset. Incomplete or corrupted messages
+// at the end are ignored. If validate is true and the first message is not at
+// firstOffset, it returns false.
+func (r *ReverseScanner) scanEnd(pos int64, firstOffset, offset uint64, validate bool) (bool, error) {
+	if _, err := r.file.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+	r.pos, r.offset = pos, firstOffset
+	// the messages are read as records, a batch containing offset is before
+	// pos, and its messages from offset are dropped when it is scanned
+	cr := crcReader{r: bufio.NewReaderSize(r.file, 65536)}
+	var msg Message
+	for first := true; ; first = false {
+		n, last, err := cr.readRecord(&msg)
+		if first && validate && (err != nil || msg.Offset != firstOffset) {
+			return false, nil
+		}
+		if err != nil || msg.Offset >= offset {
+			return true, nil
+		}
+		r.pos += n
+		r.offset = last + 1
+		if r.offset > offset {
+			r.offset = offset
+		}
+	}
+}
+
+// openFile opens the journal file at fileIndex and skips its header
+func (r *ReverseScanner) openFile() error {
+	file, header, err := openSegment(r.files[r.fileIndex].FileName)
+	if err != nil {
+		return err
+	}
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	aead, err := segmentAEAD(header, r.keys)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.header, r.start, r.aead = file, header, start, aead
+	return nil
+}
+
+// openPrevFile opens the previous journal file and moves the position to its end
+func (r *ReverseScanner) openPrevFile() error {
+	r.fileIndex--
+	if err := r.openFile(); err != nil {
+		return err
+	}
+	end, err := r.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	r.pos = end
+	return nil
+}
+
+// Scan scans the message before the previously scanned one. It returns false
+// when the first message has been scanned or an error occurs.
+func (r *ReverseScanner) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	for len(r.batch) == 0 {
+		for r.pos <= r.start {
+			if r.fileIndex == 0 {
+				return false
+			}
+			if r.err = r.openPrevFile(); r.err != nil {
+				return false
+			}
+		}
+		if _, r.err = r.file.ReadAt(r.buf[:4], r.pos-4); r.err != nil {
+			return false
+		}
+		size := int64(int32(binary.BigEndian.Uint32(r.buf[:4])))
+		if size <= 4 || size > r.pos-r.start {
+			r.err = errMessageCorrupted
+			return false
+		}
+		if r.err = r.readRecord(size); r.err != nil {
+			return false
+		}
+		r.pos -= size
+	}
+	r.message = r.batch[len(r.batch)-1]
+	r.batch = r.batch[:len(r.batch)-1]
+
+	// check offset, messages may have been removed from a compacted file
+	compacted := r.header != nil && r.header.Compacted
+	if r.message.Offset+1 != r.offset && !(compacted && r.message.Offset < r.offset) {
+		r.err = &ScanOffsetError{
+			File:           r.file.Name(),
+			Offset:         r.message.Offset,
+			Timestamp:      r.message.Timestamp,
+			ExpectedOffset: r.offset - 1,
+		}
+		return false
+	}
+	r.offset = r.message.Offset
+	return true
+}
+
+// readRecord reads the message, or the messages of the batch before offset,
+// in the record of size bytes before pos into r.batch
+func (r *ReverseScanner) readRecord(size int64) error {
+	cr := crcReader{r: io.NewSectionReader(r.file, r.pos-size, size), aead: r.aead}
+	var msg Message
+	if _, err := msg.readFrom(&cr, false, nil); err != nil {
+		return err
+	}
+	r.batch = append(r.batch[:0], msg)
+	for cr.batch != nil && cr.batch.Len() > 0 {
+		var msg Message
+		if _, err := msg.readFrom(&cr, false, nil); err != nil {
+			return err
+		}
+		if msg.Offset >= r.offset {
+			break
+		}
+		r.batch = append(r.batch, msg)
+	}
+	return nil
+}
+
+func (r *ReverseScanner) Message() *Message {
+	return &r.message
+}
+
+func (r *ReverseScanner) Err() error {
+	return r.err
+}
+
+// Offset returns the current offset of the reverse scanner, i.e. the offset of
+// the last scanned message, and the next Scan reads the message before it
+func (r *ReverseScanner) Offset() uint64 {
+	return r.offset
+}
+
+// Close closes the reverse scanner
+func (r *ReverseScanner) Close() error {
+	return r.file.Close()
+}
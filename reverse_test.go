@@ -0,0 +1,79 @@
+package sej
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReverseScan(t *testing.T) {
+	path := newTestPath(t)
+	// 3 messages per segment
+	w := newTestWriterOptions(t, path, WriterOptions{SegmentSize: headerSize + 3*(metaSize+1), IndexInterval: 1})
+	for i := 0; i < 10; i++ {
+		writeTestMessages(t, w, strconv.Itoa(i))
+	}
+	closeTestWriter(t, w)
+
+	for _, testcase := range []struct {
+		offset   uint64
+		expected string
+	}{
+		{offset: math.MaxUint64, expected: "9876543210"},
+		{offset: 10, expected: "9876543210"},
+		{offset: 6, expected: "543210"},
+		{offset: 5, expected: "43210"},
+		{offset: 1, expected: "0"},
+		{offset: 0, expected: ""},
+	} {
+		r, err := NewReverseScanner(path, testcase.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := ""
+		for r.Scan() {
+			values += string(r.Message().Value)
+			if r.Offset() != r.Message().Offset {
+				t.Fatalf("expect offset %d but got %d", r.Message().Offset, r.Offset())
+			}
+		}
+		if r.Err() != nil {
+			t.Fatal(r.Err())
+		}
+		r.Close()
+		if values != testcase.expected {
+			t.Fatalf("offset %d: expect %s but got %s", testcase.offset, testcase.expected, values)
+		}
+	}
+}
+
+func TestReverseScanCompacted(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1)
+	for _, key := range []string{"a", "b", "a", "c", "b"} {
+		if err := w.Append(&Message{Key: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+	if _, err := NewCompactor(path).Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReverseScanner(path, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var offsets []uint64
+	for r.Scan() {
+		offsets = append(offsets, r.Message().Offset)
+	}
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+	if expected := []uint64{4, 3, 2}; !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expect %v but got %v", expected, offsets)
+	}
+}
@@ -1,6 +1,7 @@
 package sej
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -9,6 +10,11 @@ var (
 	// NotifyTimeout is the timeout value in rare cases that the OS notification fails
 	// to capture the file/directory change events
 	NotifyTimeout = time.Hour
+
+	// DefaultChangeDetection is the ChangeDetection of a new scanner unless set in ScannerOptions
+	DefaultChangeDetection = DetectAuto
+	// DefaultPollInterval is the PollInterval of a new scanner unless set in ScannerOptions
+	DefaultPollInterval = time.Second
 )
 
 // Scanner implements reading of messages from segmented journal files
@@ -17,10 +23,13 @@ type Scanner struct {
 	journalDir  *watchedJournalDir
 	journalFile *JournalFile
 	file        watchedReadSeekCloser
+	header      *SegmentHeader
+	headerRead  bool
 	message     Message
+	reader      crcReader // reused for reading messages without allocation
 	err         error
 
-	Timeout time.Duration // read timeout when no data arrived, default 0
+	opts ScannerOptions
 }
 type watchedReadSeekCloser interface {
 	readSeekCloser
@@ -28,50 +37,203 @@ type watchedReadSeekCloser interface {
 	Name() string
 }
 
-// NewScanner creates a scanner for reading dir/jnl starting from offset
-// Default Timeout is 1 second
+// NewScanner creates a scanner for reading dir/jnl starting from offset with
+// the default options
 func NewScanner(dir string, offset uint64) (*Scanner, error) {
-	dir = JournalDirPath(dir)
-	r := Scanner{Timeout: time.Second}
-	journalDir, err := openWatchedJournalDir(dir)
+	return NewScannerOptions(context.Background(), dir, offset, ScannerOptions{})
+}
+
+// NewScannerContext creates a scanner like NewScanner, but waiting for the
+// message at offset can be cancelled by ctx
+func NewScannerContext(ctx context.Context, dir string, offset uint64) (*Scanner, error) {
+	return NewScannerOptions(ctx, dir, offset, ScannerOptions{})
+}
+
+// NewScannerOptions creates a scanner like NewScannerContext with opts,
+// returning an OptionError if any option is invalid
+func NewScannerOptions(ctx context.Context, dir string, offset uint64, opts ScannerOptions) (*Scanner, error) {
+	opts, err := opts.validate()
 	if err != nil {
 		return nil, err
 	}
-	journalFile, err := journalDir.Find(offset)
+	dir = JournalDirPath(dir)
+	journalDir, err := openWatchedJournalDir(dir, opts.ChangeDetection)
 	if err != nil {
 		return nil, err
 	}
-	if journalDir.IsLast(journalFile) {
-		r.file, err = openWatchedFile(journalFile.FileName)
-	} else {
-		r.file, err = openDummyWatchedFile(journalFile.FileName)
+	r := Scanner{
+		journalDir: journalDir,
+		opts:       opts,
 	}
-	if err != nil {
+	if err := r.seek(ctx, offset); err != nil {
+		journalDir.Close()
 		return nil, err
 	}
-	r.offset = journalFile.FirstOffset
-	r.journalFile = journalFile
-	r.journalDir = journalDir
-	for r.offset < offset && r.Scan() {
-	}
 	// ignore r.Err(), which will be detected by the caller later anyway
 	// ignore the difference between r.offset and offset, in case the journal has been truncated
 	// TODO: add a testcase
 	return &r, nil
 }
 
+// Seek moves the scanner to the message at offset, so that the next Scan reads it.
+// The offset index of the journal file is used to avoid reading from the
+// beginning of the file, and is built if a closed journal file has no index.
+// Errors other than failing to open the journal file are reported by Err.
+func (r *Scanner) Seek(offset uint64) error {
+	return r.seek(context.Background(), offset)
+}
+
+func (r *Scanner) seek(ctx context.Context, offset uint64) error {
+	journalFile, err := r.journalDir.Find(offset)
+	if err != nil {
+		return err
+	}
+	closed := !r.journalDir.IsLast(journalFile)
+	file, err := r.openFile(journalFile)
+	if err != nil {
+		return err
+	}
+	if r.file != nil {
+		if err := r.closeFile(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	r.file = file
+	r.journalFile = journalFile
+	r.offset = journalFile.FirstOffset
+	r.reader.resetBatch()
+	r.headerRead = false
+	// an error is reported when scanning, which reads the header again
+	r.readHeader()
+	r.err = nil
+	if r.headerRead && offset > r.offset {
+		r.seekIndex(offset, closed)
+	}
+	for r.offset < offset && r.scan(ctx, nil) {
+	}
+	return nil
+}
+
+// SeekTime moves the scanner to the first message with a timestamp no earlier than t,
+// so that the next Scan reads it. If there is no such message, the scanner is
+// moved to the end of the journal without waiting for new messages.
+// The time index of the journal files is used to skip the messages earlier than t.
+// Errors other than failing to open the journal file are reported by Err.
+func (r *Scanner) SeekTime(t time.Time) error {
+	files, err := r.journalDir.Files()
+	if err != nil {
+		return err
+	}
+	offset := files[0].FirstOffset
+	for i := range files {
+		closed := i < len(files)-1
+		entry, ok, last, err := files[i].searchTimeIndex(t, closed)
+		if err != nil {
+			// fall back to scanning from the beginning of the file
+			offset = files[i].FirstOffset
+			break
+		}
+		if ok && last && closed {
+			// all the messages in the file are earlier than t
+			continue
+		}
+		offset = files[i].FirstOffset
+		if ok {
+			offset = entry.Offset + 1
+		}
+		break
+	}
+	// search until the tail without waiting, and without skipping the
+	// messages filtered out
+	stopAtTail := r.opts.StopAtTail
+	r.opts.StopAtTail = true
+	defer func() { r.opts.StopAtTail = stopAtTail }()
+	if err := r.Seek(offset); err != nil {
+		return err
+	}
+	for r.scan(context.Background(), nil) {
+		if !r.message.Timestamp.Before(t) {
+			return r.Seek(r.message.Offset)
+		}
+	}
+	if r.err == io.EOF {
+		// at the end of the journal
+		r.err = nil
+	}
+	return nil
+}
+
+// seekIndex moves the file position to the closest indexed message before offset.
+// It fails silently so that the caller can always fall back to scanning.
+func (r *Scanner) seekIndex(offset uint64, closed bool) {
+	entry, ok, err := r.journalFile.searchIndex(offset, closed)
+	if err != nil || !ok {
+		return
+	}
+	start, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	if _, err := r.file.Seek(entry.Position, io.SeekStart); err != nil {
+		return
+	}
+	// the indexed message is read as a record without the key
+	cr := crcReader{r: r.file}
+	n, _, err := cr.readRecord(&r.message)
+	if err == nil && r.message.Offset == entry.Offset {
+		if _, err := r.file.Seek(-n, io.SeekCurrent); err == nil {
+			r.offset = entry.Offset
+			return
+		}
+	}
+	// the index is stale, e.g. the journal has been truncated
+	r.file.Seek(start, io.SeekStart)
+}
+
 // Scan scans the next message and increment the offset
 func (r *Scanner) Scan() bool {
-	if r.err != nil && r.err != ErrTimeout {
+	return r.ScanContext(context.Background())
+}
+
+// ScanContext scans the next message like Scan, but returns false immediately
+// when ctx is done, with Err returning ctx.Err(). Like ErrTimeout, the scanner
+// can continue scanning after the cancellation.
+func (r *Scanner) ScanContext(ctx context.Context) bool {
+	return r.scan(ctx, r.opts.Filter)
+}
+
+// scan scans the next message matched by filter, or any message if filter is nil
+func (r *Scanner) scan(ctx context.Context, filter func(*Message) bool) bool {
+	if r.err != nil && !resumable(r.err) {
+		return false
+	}
+	if r.err = ctx.Err(); r.err != nil {
 		return false
 	}
+	flushed := false
 	for {
+		if r.opts.EndOffset != 0 && r.offset >= r.opts.EndOffset {
+			r.err = io.EOF
+			return false
+		}
 		fileChanged, dirChanged := r.file.Watch(), r.journalDir.Watch()
+		localChanged := r.journalDir.WatchLocal()
 		var n int64
-		n, r.err = r.message.ReadFrom(r.file)
+		if !r.headerRead {
+			r.err = r.readHeader()
+		}
+		if r.headerRead {
+			r.reader.r = r.file
+			n, r.err = r.message.readFrom(&r.reader, r.opts.ZeroCopy, filter)
+		}
+		skipped := r.err == errMessageSkipped
+		if skipped {
+			r.err = nil
+		}
 		if r.err != nil {
 			// rollback the reader
-			if _, seekErr := r.file.Seek(-n, io.SeekCurrent); seekErr != nil {
+			if seekErr := r.rollback(n); seekErr != nil {
 				return false
 			}
 
@@ -90,10 +252,28 @@ func (r *Scanner) Scan() bool {
 				continue
 			}
 
-			// the last file, wait for any changes
+			// the last file, read the messages buffered by the writer in the
+			// same process if any
+			if r.opts.ReadUnflushed && !flushed {
+				flushed = true
+				if w := r.journalDir.LocalWriter(); w != nil && w.Flush() == nil {
+					continue
+				}
+			}
+
+			if r.opts.StopAtTail {
+				r.err = io.EOF
+				return false
+			}
+
+			// wait for any changes
 			var timeoutChan <-chan time.Time
-			if r.Timeout != 0 {
-				timeoutChan = time.After(r.Timeout)
+			if r.opts.Timeout != 0 {
+				timeoutChan = time.After(r.opts.Timeout)
+			}
+			var pollChan <-chan time.Time
+			if r.polling(fileChanged, dirChanged) {
+				pollChan = time.After(r.opts.PollInterval)
 			}
 			select {
 			case <-dirChanged:
@@ -101,18 +281,54 @@ func (r *Scanner) Scan() bool {
 					return false
 				}
 			case <-fileChanged:
+			case <-localChanged:
+				flushed = false
+			case <-pollChan:
 			case <-timeoutChan:
 				r.err = ErrTimeout
 				return false
+			case <-ctx.Done():
+				r.err = ctx.Err()
+				return false
 			case <-time.After(NotifyTimeout):
 			}
 			continue
 		}
-		break
+
+		if !r.advance(n) {
+			return false
+		}
+		if !skipped {
+			return true
+		}
 	}
+}
 
-	// check offset
-	if r.message.Offset != r.offset {
+// readHeader reads the header of the current file and the key of its messages.
+// On failure, the file is rolled back so that the header can be read again.
+func (r *Scanner) readHeader() error {
+	// ReadSegmentHeader rolls back by itself
+	header, err := ReadSegmentHeader(r.file)
+	r.header = header
+	if err != nil {
+		return err
+	}
+	aead, err := segmentAEAD(header, r.opts.KeyProvider)
+	if err != nil {
+		if _, seekErr := r.file.Seek(0, io.SeekStart); seekErr != nil {
+			return seekErr
+		}
+		return err
+	}
+	r.reader.aead = aead
+	r.headerRead = true
+	return nil
+}
+
+// advance checks the message of n bytes just read and moves the offset after it
+func (r *Scanner) advance(n int64) bool {
+	// check offset, messages may have been removed from a compacted file
+	if r.message.Offset != r.offset && !(r.compacted() && r.message.Offset > r.offset) {
 		r.err = &ScanOffsetError{
 			File:           r.file.Name(),
 			Offset:         r.message.Offset,
@@ -124,10 +340,53 @@ func (r *Scanner) Scan() bool {
 		return false
 	}
 
+	// leave the message beyond the end unread
+	if r.beyondEnd(&r.message) {
+		if r.err = r.rollback(n); r.err == nil {
+			r.err = io.EOF
+		}
+		return false
+	}
+
 	r.offset = r.message.Offset + 1
 	return true
 }
 
+// rollback moves back before the message of n bytes just read. If n is 0,
+// the message is either not read at all or not the first one of a batch.
+func (r *Scanner) rollback(n int64) error {
+	if n == 0 {
+		r.reader.unreadBatch()
+		return nil
+	}
+	r.reader.resetBatch()
+	_, err := r.file.Seek(-n, io.SeekCurrent)
+	return err
+}
+
+// polling returns true if the changes should be checked every poll interval,
+// either configured explicitly or because inotify is unavailable
+func (r *Scanner) polling(fileChanged, dirChanged chan bool) bool {
+	switch r.opts.ChangeDetection {
+	case DetectPoll, DetectHybrid:
+		return r.opts.PollInterval > 0
+	}
+	return r.opts.PollInterval > 0 && (fileChanged == nil || dirChanged == nil)
+}
+
+// beyondEnd returns true if msg is at or beyond EndOffset or EndTime
+func (r *Scanner) beyondEnd(msg *Message) bool {
+	if r.opts.EndOffset != 0 && msg.Offset >= r.opts.EndOffset {
+		return true
+	}
+	return !r.opts.EndTime.IsZero() && !msg.Timestamp.Before(r.opts.EndTime)
+}
+
+// resumable returns true if scanning can continue after the error
+func resumable(err error) bool {
+	return err == ErrTimeout || err == context.Canceled || err == context.DeadlineExceeded
+}
+
 func (r *Scanner) Message() *Message {
 	return &r.message
 }
@@ -141,23 +400,75 @@ func (r *Scanner) reopenFile() error {
 	if err != nil {
 		return err
 	}
-	var newFile watchedReadSeekCloser
-	if r.journalDir.IsLast(journalFile) {
-		newFile, err = openWatchedFile(journalFile.FileName)
-	} else {
-		newFile, err = openDummyWatchedFile(journalFile.FileName)
+	if journalFile.FirstOffset == r.journalFile.FirstOffset {
+		if r.journalDir.IsLast(journalFile) || !r.compacted() {
+			// the directory changed but not the file being read, e.g. an index file is created
+			return nil
+		}
+		// the last messages of a compacted file have been removed,
+		// continue from the next file
+		if journalFile, err = r.nextFile(journalFile); err != nil {
+			return err
+		}
+		r.offset = journalFile.FirstOffset
 	}
+	newFile, err := r.openFile(journalFile)
 	if err != nil {
 		return err
 	}
-	if err := r.file.Close(); err != nil {
+	if err := r.closeFile(); err != nil {
 		return err
 	}
 	r.file = newFile
 	r.journalFile = journalFile
+	r.header, r.headerRead = nil, false
+	r.reader.resetBatch()
 	return nil
 }
 
+func (r *Scanner) nextFile(journalFile *JournalFile) (*JournalFile, error) {
+	files, err := r.journalDir.Files()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(files)-1; i++ {
+		if files[i].FirstOffset == journalFile.FirstOffset {
+			return &files[i+1], nil
+		}
+	}
+	return &files[len(files)-1], nil
+}
+
+func (r *Scanner) compacted() bool {
+	return r.header != nil && r.header.Compacted
+}
+
+// closeFile closes the current file. The key, headers and value of the
+// message are dropped if they alias the memory-mapped file, so that they are
+// neither accessed nor reused as buffers afterwards.
+func (r *Scanner) closeFile() error {
+	if _, ok := r.file.(*mappedFile); ok {
+		r.message.Key, r.message.Headers, r.message.Value = nil, nil, nil
+	}
+	return r.file.Close()
+}
+
+func (r *Scanner) openFile(journalFile *JournalFile) (watchedReadSeekCloser, error) {
+	if r.journalDir.IsLast(journalFile) {
+		return openWatchedFile(journalFile.FileName, r.opts.ChangeDetection, r.opts.BufferSize)
+	}
+	if r.opts.ZeroCopy {
+		return openMappedFile(journalFile.FileName)
+	}
+	return openDummyWatchedFile(journalFile.FileName, r.opts.BufferSize)
+}
+
+// Header returns the header of the current segment file, or nil if the file
+// is a legacy file without a header
+func (r *Scanner) Header() *SegmentHeader {
+	return r.header
+}
+
 // Offset returns the current offset of the reader, i.e. last_message.offset + 1
 func (r *Scanner) Offset() uint64 {
 	return r.offset
@@ -166,7 +477,7 @@ func (r *Scanner) Offset() uint64 {
 // Close closes the reader
 func (r *Scanner) Close() error {
 	err1 := r.journalDir.Close()
-	err2 := r.file.Close()
+	err2 := r.closeFile()
 	if err1 != nil {
 		return err1
 	}
@@ -177,8 +488,8 @@ type dummyWatchedFile struct {
 	*fileReader
 }
 
-func openDummyWatchedFile(file string) (*dummyWatchedFile, error) {
-	f, err := openFileReader(file)
+func openDummyWatchedFile(file string, bufferSize int) (*dummyWatchedFile, error) {
+	f, err := openFileReader(file, bufferSize)
 	if err != nil {
 		return nil, err
 	}
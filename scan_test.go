@@ -1,6 +1,10 @@
 package sej
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"os"
 	"testing"
 	"time"
 )
@@ -96,11 +100,7 @@ func TestScanTimeoutAndAgain(t *testing.T) {
 	path := newTestPath(t)
 	w := newTestWriter(t, path, 1000)
 
-	s, err := NewScanner(path, 0)
-	s.Timeout = time.Nanosecond
-	if err != nil {
-		t.Fatal(err)
-	}
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: time.Nanosecond})
 	defer s.Close()
 
 	if s.Scan() == true {
@@ -125,3 +125,355 @@ func TestScanTimeoutAndAgain(t *testing.T) {
 		t.Fatalf("expect msg %s, got %s", expectedMsg, actualMsg)
 	}
 }
+
+func TestScanContextCancelAndAgain(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1000)
+	defer closeTestWriter(t, w)
+
+	// waiting for an offset beyond the end is cancelled
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	s, err := NewScannerContext(cancelled, path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Err() != context.Canceled {
+		t.Fatalf("expect context.Canceled but got %v", s.Err())
+	}
+	s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s = newTestScanner(t, path, 0, ScannerOptions{Timeout: -1}) // wait forever without cancellation
+	defer s.Close()
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if s.ScanContext(ctx) {
+		t.Fatal("Scan should return false")
+	}
+	if s.Err() != context.Canceled {
+		t.Fatalf("expect context.Canceled but got %v", s.Err())
+	}
+
+	writeTestMessages(t, w, "a")
+	flushTestWriter(t, w)
+	if !s.ScanContext(context.Background()) {
+		t.Fatal(s.Err())
+	}
+	if msg := string(s.Message().Value); msg != "a" {
+		t.Fatalf("expect msg a, got %s", msg)
+	}
+}
+
+func TestScanEnd(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, metaSize+1)
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, value := range []string{"a", "b", "c", "d"} {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(i) * time.Second), Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestWriter(t, w)
+	defer closeTestWriter(t, w)
+
+	scanAll := func(opts ScannerOptions) (string, uint64) {
+		opts.Timeout = -1 // never returns without a bound
+		s := newTestScanner(t, path, 0, opts)
+		defer s.Close()
+		values := ""
+		for s.Scan() {
+			values += string(s.Message().Value)
+		}
+		if s.Err() != io.EOF {
+			t.Fatalf("expect io.EOF but got %v", s.Err())
+		}
+		return values, s.Offset()
+	}
+	for _, testcase := range []struct {
+		name     string
+		opts     ScannerOptions
+		expected string
+		offset   uint64
+	}{
+		{"EndOffset", ScannerOptions{EndOffset: 2}, "ab", 2},
+		{"EndTime", ScannerOptions{EndTime: base.Add(2500 * time.Millisecond)}, "abc", 3},
+		{"StopAtTail", ScannerOptions{StopAtTail: true}, "abcd", 4},
+	} {
+		values, offset := scanAll(testcase.opts)
+		if values != testcase.expected || offset != testcase.offset {
+			t.Fatalf("%s: expect %s at %d but got %s at %d", testcase.name, testcase.expected, testcase.offset, values, offset)
+		}
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 3*(metaSize+1000))
+	defer closeTestWriter(t, w)
+	for i := 0; i < 10; i++ {
+		value := make([]byte, 1000)
+		value[0] = byte('0' + i)
+		if err := w.Append(&Message{Type: byte(i % 3), Key: []byte{byte('a' + i)}, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestWriter(t, w)
+
+	for _, zeroCopy := range []bool{false, true} {
+		s := newTestScanner(t, path, 0, ScannerOptions{
+			ZeroCopy:   zeroCopy,
+			StopAtTail: true,
+			Filter:     func(msg *Message) bool { return msg.Type == 1 },
+		})
+		values := ""
+		for s.Scan() {
+			msg := s.Message()
+			if msg.Type != 1 || len(msg.Value) != 1000 || msg.Key[0]-'a' != msg.Value[0]-'0' {
+				t.Fatalf("unexpected message %d of type %d", msg.Offset, msg.Type)
+			}
+			values += string(msg.Value[:1])
+		}
+		if s.Err() != io.EOF {
+			t.Fatal(s.Err())
+		}
+		if values != "147" || s.Offset() != 10 {
+			t.Fatalf("expect 147 at 10 but got %s at %d", values, s.Offset())
+		}
+		s.Close()
+	}
+}
+
+func TestScanHeaders(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 100)
+	defer closeTestWriter(t, w)
+	for i := 0; i < 6; i++ {
+		msg := Message{Value: []byte{byte('0' + i)}}
+		if i%2 == 0 {
+			msg.Headers = []Header{{Name: "id", Value: []byte{byte('a' + i)}}}
+		}
+		if err := w.Append(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestWriter(t, w)
+
+	for _, zeroCopy := range []bool{false, true} {
+		s := newTestScanner(t, path, 0, ScannerOptions{
+			ZeroCopy:   zeroCopy,
+			StopAtTail: true,
+			Filter:     func(msg *Message) bool { return len(msg.Headers) > 0 },
+		})
+		values := ""
+		for s.Scan() {
+			msg := s.Message()
+			values += string(msg.Value) + string(msg.Headers[0].Value)
+		}
+		if s.Err() != io.EOF {
+			t.Fatal(s.Err())
+		}
+		if values != "0a2c4e" {
+			t.Fatalf("expect 0a2c4e but got %s", values)
+		}
+		s.Close()
+	}
+}
+
+func TestScanMixedFormats(t *testing.T) {
+	path := newTestPath(t)
+	longKey := bytes.Repeat([]byte("k"), 300)
+	w := newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "a")
+	if err := w.Append(&Message{Key: longKey, Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	closeTestWriter(t, w)
+
+	// append messages in the older formats to the last journal file
+	var buf bytes.Buffer
+	for i, format := range []byte{formatV0, formatV1, formatV2} {
+		msg := Message{Offset: uint64(2 + i), Key: []byte("k"), Value: []byte{byte('c' + i)}}
+		if _, err := writeMessage(&buf, make([]byte, 8), &msg, format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := journalFileName(JournalDirPath(path), 2)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the corrupted last message with a long key is truncated
+	w = newTestWriter(t, path)
+	if err := w.Append(&Message{Key: longKey, Value: []byte("f")}); err != nil {
+		t.Fatal(err)
+	}
+	closeTestWriter(t, w)
+	truncateFile(t, file, 1)
+	if _, err := NewWriter(path); err == nil {
+		t.Fatal("expect corruption error but got nil")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Fatalf("expect corruption error but got %v", err)
+	}
+	w = newTestWriter(t, path)
+	if err := w.Append(&Message{Key: longKey, Value: []byte("f")}); err != nil {
+		t.Fatal(err)
+	}
+	closeTestWriter(t, w)
+
+	for _, zeroCopy := range []bool{false, true} {
+		s := newTestScanner(t, path, 0, ScannerOptions{ZeroCopy: zeroCopy, StopAtTail: true})
+		values := ""
+		for s.Scan() {
+			msg := s.Message()
+			if (msg.Offset == 1 || msg.Offset == 5) && !bytes.Equal(msg.Key, longKey) {
+				t.Fatalf("expect long key at %d but got %d bytes", msg.Offset, len(msg.Key))
+			}
+			values += string(msg.Value)
+		}
+		if s.Err() != io.EOF {
+			t.Fatal(s.Err())
+		}
+		if values != "abcdef" {
+			t.Fatalf("expect abcdef but got %s", values)
+		}
+		s.Close()
+	}
+}
+
+func TestScanCRCMismatch(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "a", "b", "c")
+	closeTestWriter(t, w)
+
+	// flip the value of the 2nd message
+	file := JournalDirPath(path) + "/0000000000000000.jnl"
+	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), int64(headerSize+(metaSize+1)+metaSize-8)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := NewScanner(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if s.Scan() {
+		t.Fatal("Scan should return false")
+	}
+	if s.Err() != ErrCRC {
+		t.Fatalf("expect ErrCRC but got %v", s.Err())
+	}
+}
+
+func TestScanSeek(t *testing.T) {
+	messages := []string{"a", "b", "c", "d", "e"}
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{SegmentSize: headerSize + 2*(metaSize+1), IndexInterval: 1})
+	writeTestMessages(t, w, messages...)
+	closeTestWriter(t, w)
+
+	s, err := NewScanner(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, offset := range []int{3, 1, 4, 0, 2} {
+		if err := s.Seek(uint64(offset)); err != nil {
+			t.Fatal(err)
+		}
+		if s.Offset() != uint64(offset) {
+			t.Fatalf("expect offset %d but got %d", offset, s.Offset())
+		}
+		if !s.Scan() {
+			t.Fatal(s.Err())
+		}
+		if actual, expected := string(s.Message().Value), messages[offset]; actual != expected {
+			t.Fatalf("expect msg %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestScanSeekTime(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriterOptions(t, path, WriterOptions{SegmentSize: headerSize + 3*(metaSize+1), IndexInterval: 1})
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	secs := []int{1, 2, 4, 3, 6, 5, 7, 9, 8}
+	for _, sec := range secs {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(sec) * time.Second), Value: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: time.Millisecond})
+	defer s.Close()
+	for _, testcase := range []struct {
+		sec    int
+		offset uint64
+	}{
+		{sec: 0, offset: 0},
+		{sec: 3, offset: 2},
+		{sec: 5, offset: 4},
+		{sec: 7, offset: 6},
+		{sec: 8, offset: 7},
+		{sec: 10, offset: 9},
+	} {
+		if err := s.SeekTime(base.Add(time.Duration(testcase.sec) * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if s.Offset() != testcase.offset {
+			t.Fatalf("%ds: expect offset %d but got %d", testcase.sec, testcase.offset, s.Offset())
+		}
+	}
+}
+
+func TestScanSeekTimeAfterTail(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := w.Append(&Message{Timestamp: base.Add(time.Duration(i) * time.Second), Value: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushTestWriter(t, w)
+
+	// no timeout, SeekTime must not wait for new messages
+	s := newTestScanner(t, path, 0, ScannerOptions{Timeout: -1})
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.SeekTime(base.Add(time.Hour)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SeekTime blocks after the last message")
+	}
+	if s.Offset() != 3 || s.Err() != nil {
+		t.Fatalf("expect offset 3 without error but got %d, %v", s.Offset(), s.Err())
+	}
+	if err := w.Append(&Message{Timestamp: base.Add(2 * time.Hour), Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	flushTestWriter(t, w)
+	if !s.Scan() || s.Message().Offset != 3 || string(s.Message().Value) != "b" {
+		t.Fatalf("expect message b at 3 but got %v, %v", s.Message(), s.Err())
+	}
+}
@@ -0,0 +1,260 @@
+package sej
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	// segmentMagic starts a segment file with a header. Its first byte has the
+	// high bit set so that it never equals the first byte of the offset of a
+	// legacy headerless segment file.
+	segmentMagic = "\x89SEJ"
+	// segmentVersion is the current version of the segment header,
+	// version 2 adds the flags after the writer ID,
+	// version 3 adds the cipher and the key ID after the flags
+	segmentVersion = 3
+	// segmentHeaderFixedSize is the header size excluding writer ID and key ID
+	segmentHeaderFixedSize = 4 + 4 + 1 + 8 + 1 + 1 + 1 + 1
+	// segmentHeaderMinSize is the size of a version 1 header without writer ID
+	segmentHeaderMinSize = 4 + 4 + 1 + 8 + 1
+
+	// segmentCompacted is the flag of a compacted segment file
+	segmentCompacted = 1 << 0
+)
+
+var (
+	errNoSegmentHeader        = errors.New("no segment header")
+	errSegmentHeaderCorrupted = errors.New("segment header is corrupted")
+)
+
+// SegmentHeader is the header at the beginning of a segment file.
+// Legacy segment files do not have a header.
+type SegmentHeader struct {
+	Version   byte
+	Created   time.Time
+	WriterID  string
+	Compacted bool   // the offsets of the messages are not contiguous after compaction
+	Cipher    Cipher // the cipher encrypting the messages, since version 3
+	KeyID     string // the ID of the key encrypting the messages, since version 3
+}
+
+// Size returns the encoded size of the header
+func (h *SegmentHeader) Size() int64 {
+	return segmentHeaderFixedSize + int64(len(h.WriterID)) + int64(len(h.KeyID))
+}
+
+// WriteTo writes the segment header
+func (h *SegmentHeader) WriteTo(w io.Writer) (int64, error) {
+	if len(h.WriterID) > math.MaxUint8 {
+		return 0, errors.New("writer ID is too long")
+	}
+	if len(h.KeyID) > math.MaxUint8 {
+		return 0, errors.New("key ID is too long")
+	}
+	buf := make([]byte, 8)
+	cnt := int64(0)
+
+	n, err := io.WriteString(w, segmentMagic)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeInt32(w, buf, int32(h.Size()))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeByte(w, buf, h.Version)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeInt64(w, buf, h.Created.UnixNano())
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeByte(w, buf, byte(len(h.WriterID)))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = io.WriteString(w, h.WriterID)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	var flags byte
+	if h.Compacted {
+		flags |= segmentCompacted
+	}
+	n, err = writeByte(w, buf, flags)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeByte(w, buf, byte(h.Cipher))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = writeByte(w, buf, byte(len(h.KeyID)))
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	n, err = io.WriteString(w, h.KeyID)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, nil
+}
+
+// ReadSegmentHeader reads the header at the beginning of a segment file.
+// It returns a nil header for a legacy segment file and rolls back the seeker
+// so that the first message can be read.
+// io.EOF is returned if the segment file is empty.
+// When an error occurs, it will rollback the seeker and then returns the original error.
+func ReadSegmentHeader(r io.ReadSeeker) (*SegmentHeader, error) {
+	var h SegmentHeader
+	n, err := h.readFrom(r)
+	if err == errNoSegmentHeader {
+		if _, err := r.Seek(-n, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	} else if err != nil {
+		if _, seekErr := r.Seek(-n, io.SeekCurrent); seekErr != nil {
+			return nil, seekErr
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h *SegmentHeader) readFrom(r io.Reader) (int64, error) {
+	cnt := int64(0)
+
+	magic := make([]byte, len(segmentMagic))
+	n, err := io.ReadFull(r, magic)
+	cnt += int64(n)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && string(magic[:n]) != segmentMagic[:n] {
+			return cnt, errNoSegmentHeader
+		}
+		return cnt, err
+	}
+	if string(magic) != segmentMagic {
+		return cnt, errNoSegmentHeader
+	}
+
+	var size int32
+	n, err = readInt32(r, &size)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+	if size < segmentHeaderMinSize {
+		return cnt, errSegmentHeaderCorrupted
+	}
+
+	// read the whole header at once, including fields unknown to this version
+	buf := make([]byte, int(size)-len(segmentMagic)-4)
+	n, err = io.ReadFull(r, buf)
+	cnt += int64(n)
+	if err != nil {
+		return cnt, err
+	}
+
+	h.Version = buf[0]
+	if h.Version == 0 {
+		return cnt, errSegmentHeaderCorrupted
+	}
+	h.Created = time.Unix(0, int64(binary.BigEndian.Uint64(buf[1:9]))).UTC()
+	idSize := int(buf[9])
+	if 10+idSize > len(buf) {
+		return cnt, errSegmentHeaderCorrupted
+	}
+	h.WriterID = string(buf[10 : 10+idSize])
+	if h.Version >= 2 {
+		if 10+idSize >= len(buf) {
+			return cnt, errSegmentHeaderCorrupted
+		}
+		flags := buf[10+idSize]
+		h.Compacted = flags&segmentCompacted != 0
+	}
+	if h.Version >= 3 {
+		pos := 11 + idSize
+		if pos+2 > len(buf) {
+			return cnt, errSegmentHeaderCorrupted
+		}
+		h.Cipher = Cipher(buf[pos])
+		keyIDSize := int(buf[pos+1])
+		if pos+2+keyIDSize > len(buf) {
+			return cnt, errSegmentHeaderCorrupted
+		}
+		h.KeyID = string(buf[pos+2 : pos+2+keyIDSize])
+	}
+	return cnt, nil
+}
+
+// Header returns the header of the journal file or nil if it is a legacy file
+// without a header
+func (journalFile *JournalFile) Header() (*SegmentHeader, error) {
+	file, err := os.Open(journalFile.FileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h, err := ReadSegmentHeader(file)
+	if err == io.EOF {
+		return nil, errJournalFileIsEmpty
+	}
+	return h, err
+}
+
+// checkHeader returns an error if the journal file has a corrupted segment
+// header. A legacy file without a header, an empty file and a header being
+// written are valid.
+func (journalFile *JournalFile) checkHeader() error {
+	_, err := journalFile.Header()
+	switch {
+	case err == nil, err == errJournalFileIsEmpty, err == io.ErrUnexpectedEOF:
+		return nil
+	case os.IsNotExist(err):
+		// not created yet
+		return nil
+	}
+	return fmt.Errorf("invalid segment header in %s: %s", journalFile.FileName, err.Error())
+}
+
+// openSegment opens a journal file and skips its header.
+// The returned header is nil for a legacy segment file.
+func openSegment(name string) (*os.File, *SegmentHeader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := ReadSegmentHeader(file)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, h, nil
+}
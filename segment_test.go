@@ -0,0 +1,115 @@
+package sej
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSegmentHeaderWriteRead(t *testing.T) {
+	for _, compacted := range []bool{false, true} {
+		h := SegmentHeader{
+			Version:   segmentVersion,
+			Created:   time.Now().UTC(),
+			WriterID:  "host:1",
+			Compacted: compacted,
+		}
+		if compacted {
+			h.Cipher, h.KeyID = CipherAESGCM, "key-1"
+		}
+		var buf bytes.Buffer
+		n, err := h.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != h.Size() {
+			t.Fatalf("expect %d bytes written but got %d", h.Size(), n)
+		}
+		result, err := ReadSegmentHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*result, h) {
+			t.Fatalf("expect\n%v\ngot\n%v", h, *result)
+		}
+	}
+}
+
+func TestSegmentHeaderVersion1(t *testing.T) {
+	h := SegmentHeader{Version: 1, Created: time.Now().UTC(), WriterID: "host:1"}
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// a version 1 header has no flags, cipher or key ID
+	b := buf.Bytes()[:buf.Len()-3]
+	b[7] -= 3
+	r := bytes.NewReader(b)
+	result, err := ReadSegmentHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*result, h) || r.Len() != 0 {
+		t.Fatalf("expect\n%v\ngot\n%v", h, *result)
+	}
+}
+
+func TestSegmentHeaderOnly(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1)
+	writeTestMessages(t, w, "a")
+	closeTestWriter(t, w)
+
+	dir, err := OpenJournalDir(JournalDirPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := dir.Last()
+	if _, err := last.FirstMessage(); err != errJournalFileIsEmpty {
+		t.Fatalf("expect errJournalFileIsEmpty but got %v", err)
+	}
+	if _, err := last.LastMessage(); err != errJournalFileIsEmpty {
+		t.Fatalf("expect errJournalFileIsEmpty but got %v", err)
+	}
+	h, err := last.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == nil || h.WriterID != testWriterID {
+		t.Fatalf("expect header written by %s but got %v", testWriterID, h)
+	}
+}
+
+func TestSegmentLegacyFile(t *testing.T) {
+	tt := Test{t}
+	path := newTestPath(t)
+	if err := os.MkdirAll(JournalDirPath(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(journalFileName(JournalDirPath(path), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	for i, value := range []string{"a", "b"} {
+		if _, err := writeMessage(f, buf, &Message{Offset: uint64(i), Value: []byte(value)}, formatV0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	jf := JournalFile{FileName: f.Name()}
+	if h, err := jf.Header(); err != nil || h != nil {
+		t.Fatalf("expect no header but got %v, %v", h, err)
+	}
+	if msg, err := jf.LastMessage(); err != nil || msg.Offset != 1 {
+		t.Fatalf("expect last message at 1 but got %v, %v", msg, err)
+	}
+
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "c")
+	closeTestWriter(t, w)
+	tt.VerifyMessageValues(path, "a", "b", "c")
+}
@@ -1,28 +1,39 @@
 package sejutil
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"h12.io/sej"
 )
 
+// defaultRetryDelay is the delay before a retry without Consumer.Timeout
+const defaultRetryDelay = time.Second
+
 type (
 	Consumer struct {
 		Dir           string
 		Offset        string
 		DefaultOffset sej.DefaultOffset
-		Timeout       time.Duration
+		Timeout       time.Duration   // 0 for no timeout
+		KeyProvider   sej.KeyProvider // decrypts encrypted journal files
 		Handler       Handler
 		ErrChan       chan error
 		LogChan       chan string
 
-		stopChan chan chan bool
-		offset   *sej.Offset
-		scanner  *sej.Scanner
+		once    sync.Once // initializes ctx, cancel and stopped for Start or Stop
+		ctx     context.Context
+		cancel  context.CancelFunc
+		stopped chan bool
+		started bool
+		mu      sync.Mutex
+		offset  *sej.Offset
+		scanner *sej.Scanner
 	}
 	Handler interface {
 		Handle(msg *sej.Message) (uint64, error)
@@ -47,14 +58,26 @@ func (c *Consumer) error(err error, format string, v ...interface{}) {
 	}
 }
 
+// Stop cancels the scanning and the retries immediately and waits until the
+// consumer is stopped. A consumer stopped before Start does not start.
 func (c *Consumer) Stop() error {
-	stoppedChan := make(chan bool)
-	c.stopChan <- stoppedChan
-	<-stoppedChan
+	c.once.Do(c.initContext)
+	c.cancel()
+	c.mu.Lock()
+	started := c.started
+	c.mu.Unlock()
+	if started {
+		<-c.stopped
+	}
 	return nil
 }
 
 func (c *Consumer) Start() (err error) {
+	c.once.Do(c.initContext)
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+	defer close(c.stopped)
 	defer func() {
 		if e := recover(); e != nil {
 			err = errors.New(fmt.Sprint(e))
@@ -64,98 +87,141 @@ func (c *Consumer) Start() (err error) {
 			fmt.Fprintf(os.Stderr, "Stack of %d bytes:\n%s\n", count, trace)
 		}
 	}()
+	if c.ctx.Err() != nil {
+		// stopped before started
+		return nil
+	}
 	if err := c.init(); err != nil {
 		return err
 	}
 	c.log("consumer started")
 
-	var stoppedChan chan bool
-consumerLoop:
 	for {
 		start := c.scanner.Offset()
-		for c.scanner.Scan() {
+		for c.scanner.ScanContext(c.ctx) {
 			msg := c.scanner.Message()
-			committed := c.handle(msg)
+			committed, ok := c.handle(msg)
+			if !ok {
+				break
+			}
 			if committed >= start {
-				start = c.commit(committed + 1)
+				if start, ok = c.commit(committed + 1); !ok {
+					break
+				}
 			}
 		}
-		committed := c.handle(nil)
-		if committed >= start {
-			start = c.commit(committed + 1)
+		if committed, ok := c.handle(nil); ok && committed >= start {
+			c.commit(committed + 1)
 		}
-		if err := c.scanner.Err(); err != nil && err != sej.ErrTimeout {
-			c.resetScanner() // reset scanner if journal is truncated
+		if c.ctx.Err() != nil {
+			break
 		}
-		select {
-		case stoppedChan = <-c.stopChan:
-			break consumerLoop
-		default:
+		if err := c.scanner.Err(); err != nil && err != sej.ErrTimeout {
+			if !c.resetScanner() { // reset scanner if journal is truncated
+				break
+			}
 		}
 		runtime.Gosched()
 	}
 	c.close()
 
 	c.log("consumer stopped")
-	stoppedChan <- true
 	return nil
 }
 
-func (c *Consumer) handle(msg *sej.Message) uint64 {
+// handle returns the committed offset returned by the handler, retrying until
+// it succeeds, or false if the consumer is stopped
+func (c *Consumer) handle(msg *sej.Message) (uint64, bool) {
 	for {
 		committed, err := c.Handler.Handle(msg)
 		if err != nil {
 			c.error(err, "fail to handle message")
-			time.Sleep(c.Timeout)
+			if !c.wait() {
+				return 0, false
+			}
 			continue
 		}
-		return committed
+		return committed, true
 	}
 }
 
-func (c *Consumer) commit(offset uint64) uint64 {
+// commit commits the offset, retrying until it succeeds, or returns false if
+// the consumer is stopped
+func (c *Consumer) commit(offset uint64) (uint64, bool) {
 	for {
 		if err := c.offset.Commit(offset); err != nil {
 			c.error(err, "")
-			time.Sleep(c.Timeout)
+			if !c.wait() {
+				return 0, false
+			}
 			continue
 		}
-		return offset
+		return offset, true
 	}
 }
 
-func (c *Consumer) resetScanner() {
+// resetScanner creates a new scanner, retrying until it succeeds, returning
+// false if the consumer is stopped
+func (c *Consumer) resetScanner() bool {
 	c.scanner.Close()
+	c.scanner = nil
 	for {
 		var err error
-		c.scanner, err = sej.NewScanner(c.Dir, c.offset.Value())
+		c.scanner, err = c.newScanner()
 		if err != nil {
 			c.error(err, "fail to reset scanner")
-			time.Sleep(c.Timeout)
+			if !c.wait() {
+				return false
+			}
 			continue
 		}
-		c.scanner.Timeout = c.Timeout
 		c.log("scanner restarted at %d", c.offset.Value())
-		return
+		return true
 	}
 }
 
+// wait waits for Timeout, or defaultRetryDelay without Timeout, before
+// retrying, returning false if the consumer is stopped in the meantime
+func (c *Consumer) wait() bool {
+	delay := c.Timeout
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *Consumer) initContext() {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.stopped = make(chan bool)
+}
+
 func (c *Consumer) init() error {
 	var err error
-	c.stopChan = make(chan chan bool, 1)
 	c.offset, err = sej.NewOffset(c.Dir, c.Offset, c.DefaultOffset)
 	if err != nil {
 		return err
 	}
-	c.scanner, err = sej.NewScanner(c.Dir, c.offset.Value())
-	if err != nil {
-		return err
+	c.scanner, err = c.newScanner()
+	return err
+}
+
+func (c *Consumer) newScanner() (*sej.Scanner, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		// no timeout instead of the default one of the scanner
+		timeout = -1
 	}
-	c.scanner.Timeout = c.Timeout
-	return nil
+	return sej.NewScannerOptions(c.ctx, c.Dir, c.offset.Value(), sej.ScannerOptions{Timeout: timeout, KeyProvider: c.KeyProvider})
 }
 
 func (c *Consumer) close() {
-	c.scanner.Close()
+	if c.scanner != nil {
+		c.scanner.Close()
+	}
 	c.offset.Close()
 }
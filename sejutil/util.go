@@ -1,49 +1,27 @@
 package sejutil
 
 import (
-	"io"
-	"os"
+	"context"
 	"time"
 
 	"h12.io/sej"
 )
 
-func NewScannerFrom(journalDir string, from time.Time) (*sej.Scanner, error) {
-	dir, err := sej.OpenJournalDir(sej.JournalDirPath(journalDir))
+// NewScannerFrom creates a scanner for reading from the first message with a
+// timestamp no earlier than from, decrypting encrypted journal files with keys
+func NewScannerFrom(journalDir string, from time.Time, keys sej.KeyProvider) (*sej.Scanner, error) {
+	s, err := sej.NewScannerOptions(context.Background(), journalDir, 0, sej.ScannerOptions{KeyProvider: keys})
 	if err != nil {
 		return nil, err
 	}
-	startOffset := dir.First().FirstOffset
-	for _, file := range dir.Files {
-		f, err := os.Open(file.FileName)
-		if err != nil {
-			return nil, err
-		}
-		var msg sej.Message
-		if _, err := msg.ReadFrom(f); err != nil && err != io.EOF {
-			f.Close()
-			return nil, err
-		}
-		f.Close()
-		if msg.Timestamp.After(from) {
-			break
-		}
-		startOffset = file.FirstOffset
-	}
-	if int(startOffset)-5000 > 0 {
-		startOffset -= 5000
-	}
-	s, err := sej.NewScanner(journalDir, startOffset)
-	if err != nil {
+	if err := s.SeekTime(from); err != nil {
+		s.Close()
 		return nil, err
 	}
-	s.Timeout = time.Second
-	for s.Scan() {
-		msg := s.Message()
-		if !msg.Timestamp.Before(from) {
-			startOffset = msg.Offset
-			break
-		}
+	// SeekTime keeps an error reading the messages in the scanner
+	if err := s.Err(); err != nil {
+		s.Close()
+		return nil, err
 	}
-	return sej.NewScanner(journalDir, startOffset)
+	return s, nil
 }
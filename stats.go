@@ -0,0 +1,272 @@
+package sej
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metaExt = ".meta"
+	// metaVersion is the current version of the meta file format
+	metaVersion = 1
+	// metaFixedSize is the size of a meta file without type histogram and checksum
+	metaFixedSize = 1 + 8 + 8 + 8 + 8 + 8 + 8 + 4 + 2
+)
+
+var errMetaCorrupted = errors.New("meta file is corrupted")
+
+// SegmentStats is the statistics of a segment file, written into its meta file
+// when the writer rolls to the next segment file
+type SegmentStats struct {
+	Count        uint64          // the number of messages, fewer than the offsets in a compacted file
+	FirstOffset  uint64          // the offset of the first message
+	LastOffset   uint64          // the offset of the last message
+	MinTimestamp time.Time       // the minimal timestamp of the messages
+	MaxTimestamp time.Time       // the maximal timestamp of the messages
+	Size         int64           // the size of the segment file in bytes
+	Types        map[byte]uint64 // the number of messages of each type
+	Checksum     uint32          // the CRC32C checksum of the whole segment file
+}
+
+func metaFileName(journalFileName string) string {
+	return strings.TrimSuffix(journalFileName, journalExt) + metaExt
+}
+
+// add counts the message into the stats
+func (s *SegmentStats) add(msg *Message) {
+	if s.Count == 0 {
+		s.FirstOffset = msg.Offset
+	}
+	if s.Count == 0 || msg.Timestamp.Before(s.MinTimestamp) {
+		s.MinTimestamp = msg.Timestamp
+	}
+	if s.Count == 0 || msg.Timestamp.After(s.MaxTimestamp) {
+		s.MaxTimestamp = msg.Timestamp
+	}
+	s.LastOffset = msg.Offset
+	if s.Types == nil {
+		s.Types = make(map[byte]uint64)
+	}
+	s.Types[msg.Type]++
+	s.Count++
+}
+
+// Stats returns the statistics of the journal file from its meta file, or
+// by reading the whole journal file if it has no valid meta file, e.g. it is
+// still being appended. In the latter case, the stats of an encrypted journal
+// file are read from the plaintext headers of its records without Types, and
+// the timestamps of a batch are its maximal one.
+func (journalFile *JournalFile) Stats() (*SegmentStats, error) {
+	if stats, err := readMeta(journalFile.FileName); err == nil {
+		return stats, nil
+	}
+	stats, err := buildStats(journalFile.FileName, nil)
+	if err == ErrNoKey {
+		return buildRecordStats(journalFile.FileName)
+	}
+	return stats, err
+}
+
+// buildStats reads the whole segment file for its stats, decrypting the
+// messages with keys if it is encrypted. An incomplete message at the end
+// is not counted.
+func buildStats(journalFileName string, keys KeyProvider) (*SegmentStats, error) {
+	f, header, err := openSegment(journalFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := NewMessageReader(bufio.NewReaderSize(f, 65536))
+	if err := r.SetKey(header, keys); err != nil {
+		return nil, err
+	}
+	var stats SegmentStats
+	var msg Message
+	for {
+		if _, err := msg.readFrom(&r.r, true, nil); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		stats.add(&msg)
+	}
+	if err := stats.sum(f); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// buildRecordStats reads the whole segment file for its stats without
+// decrypting its records, so the messages in a batch are counted but their
+// types and timestamps are unknown. An incomplete record at the end is not
+// counted.
+func buildRecordStats(journalFileName string) (*SegmentStats, error) {
+	f, _, err := openSegment(journalFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := crcReader{r: bufio.NewReaderSize(f, 65536)}
+	var stats SegmentStats
+	var msg Message
+	for {
+		_, last, err := r.readRecord(&msg)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if stats.Count == 0 {
+			stats.FirstOffset = msg.Offset
+		}
+		if stats.Count == 0 || msg.Timestamp.Before(stats.MinTimestamp) {
+			stats.MinTimestamp = msg.Timestamp
+		}
+		if stats.Count == 0 || msg.Timestamp.After(stats.MaxTimestamp) {
+			stats.MaxTimestamp = msg.Timestamp
+		}
+		stats.LastOffset = last
+		stats.Count += last - msg.Offset + 1
+	}
+	if err := stats.sum(f); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// sum sets the size and the checksum of the whole segment file f
+func (s *SegmentStats) sum(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := crc32.New(crcTable)
+	var err error
+	if s.Size, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	s.Checksum = h.Sum32()
+	return nil
+}
+
+// writeMeta writes the meta file of the journal file atomically by renaming
+func writeMeta(journalFileName string, stats *SegmentStats) error {
+	tmp, err := createTempIndex(metaFileName(journalFileName))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = stats.writeTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), metaFileName(journalFileName))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// readMeta reads the stats from the meta file of the journal file
+func readMeta(journalFileName string) (*SegmentStats, error) {
+	data, err := ioutil.ReadFile(metaFileName(journalFileName))
+	if err != nil {
+		return nil, err
+	}
+	var stats SegmentStats
+	if err := stats.unmarshal(data); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// writeTo writes the stats in the meta file format followed by the CRC32C
+// checksum of the meta file
+func (s *SegmentStats) writeTo(w io.Writer) error {
+	buf := make([]byte, 8)
+	cw := crcWriter{w: w}
+	if _, err := writeByte(&cw, buf, metaVersion); err != nil {
+		return err
+	}
+	for _, i := range []uint64{
+		s.Count,
+		s.FirstOffset,
+		s.LastOffset,
+		uint64(unixNano(s.MinTimestamp)),
+		uint64(unixNano(s.MaxTimestamp)),
+		uint64(s.Size),
+	} {
+		if _, err := writeUint64(&cw, buf, i); err != nil {
+			return err
+		}
+	}
+	if _, err := writeUint32(&cw, s.Checksum); err != nil {
+		return err
+	}
+	types := make([]int, 0, len(s.Types))
+	for typ := range s.Types {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+	if _, err := writeUint16(&cw, buf, uint16(len(types))); err != nil {
+		return err
+	}
+	for _, typ := range types {
+		if _, err := writeByte(&cw, buf, byte(typ)); err != nil {
+			return err
+		}
+		if _, err := writeUint64(&cw, buf, s.Types[byte(typ)]); err != nil {
+			return err
+		}
+	}
+	_, err := writeUint32(w, cw.crc)
+	return err
+}
+
+func (s *SegmentStats) unmarshal(data []byte) error {
+	if len(data) < metaFixedSize+4 {
+		return errMetaCorrupted
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(body):]) {
+		return errMetaCorrupted
+	}
+	if body[0] != metaVersion {
+		return errMetaCorrupted
+	}
+	s.Count = binary.BigEndian.Uint64(body[1:])
+	s.FirstOffset = binary.BigEndian.Uint64(body[9:])
+	s.LastOffset = binary.BigEndian.Uint64(body[17:])
+	s.MinTimestamp = fromUnixNano(int64(binary.BigEndian.Uint64(body[25:])))
+	s.MaxTimestamp = fromUnixNano(int64(binary.BigEndian.Uint64(body[33:])))
+	s.Size = int64(binary.BigEndian.Uint64(body[41:]))
+	s.Checksum = binary.BigEndian.Uint32(body[49:])
+	typeCount := int(binary.BigEndian.Uint16(body[53:]))
+	if len(body) != metaFixedSize+typeCount*9 {
+		return errMetaCorrupted
+	}
+	s.Types = nil
+	for i := 0; i < typeCount; i++ {
+		entry := body[metaFixedSize+i*9:]
+		if s.Types == nil {
+			s.Types = make(map[byte]uint64, typeCount)
+		}
+		s.Types[entry[0]] = binary.BigEndian.Uint64(entry[1:])
+	}
+	return nil
+}
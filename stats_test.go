@@ -0,0 +1,170 @@
+package sej
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSegmentStats(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, codec := range []Codec{CodecNone, CodecZstd} {
+		path := newTestPath(t)
+		w := newTestWriterOptions(t, path, WriterOptions{
+			SegmentSize: 300,
+			Codec:       codec,
+			BatchSize:   100,
+		})
+		for i := 0; i < 30; i++ {
+			// timestamps out of order within a segment
+			ts := start.Add(time.Duration(i%3) * time.Hour).Add(time.Duration(i) * time.Second)
+			if err := w.Append(&Message{Timestamp: ts, Type: byte(i % 2), Value: []byte(strconv.Itoa(i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeTestWriter(t, w)
+
+		dir, err := OpenJournalDir(JournalDirPath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dir.Files) < 3 {
+			t.Fatalf("codec %d: expect at least 3 segment files but got %d", codec, len(dir.Files))
+		}
+		var count uint64
+		for i, journalFile := range dir.Files {
+			last := i == len(dir.Files)-1
+			stats, err := readMeta(journalFile.FileName)
+			if last {
+				if !os.IsNotExist(err) {
+					t.Fatalf("codec %d: expect no meta file for the last segment but got %v", codec, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			built, err := buildStats(journalFile.FileName, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stats, built) {
+				t.Fatalf("codec %d: expect stats %v but got %v", codec, built, stats)
+			}
+			if stats.FirstOffset != journalFile.FirstOffset || stats.LastOffset != dir.Files[i+1].FirstOffset-1 {
+				t.Fatalf("codec %d: expect offsets %d-%d but got %d-%d", codec, journalFile.FirstOffset, dir.Files[i+1].FirstOffset-1, stats.FirstOffset, stats.LastOffset)
+			}
+			if stats.Count != stats.Types[0]+stats.Types[1] {
+				t.Fatalf("codec %d: expect count %d but got types %v", codec, stats.Count, stats.Types)
+			}
+			if !stats.MinTimestamp.Before(stats.MaxTimestamp) {
+				t.Fatalf("codec %d: expect min timestamp %v before max timestamp %v", codec, stats.MinTimestamp, stats.MaxTimestamp)
+			}
+			count += stats.Count
+		}
+		stats, err := dir.Last().Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count += stats.Count; count != 30 {
+			t.Fatalf("codec %d: expect 30 messages but got %d", codec, count)
+		}
+	}
+}
+
+func TestSegmentStatsRestart(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "a", "b", "c")
+	closeTestWriter(t, w)
+	first := journalFileName(JournalDirPath(path), 0)
+	if err := writeMeta(first, &SegmentStats{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale meta file is removed and the appended file is read on roll
+	w = newTestWriter(t, path, 1)
+	if _, err := os.Stat(metaFileName(first)); !os.IsNotExist(err) {
+		t.Fatalf("expect stale meta file removed but got %v", err)
+	}
+	writeTestMessages(t, w, "d")
+	closeTestWriter(t, w)
+	stats, err := readMeta(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 4 || stats.FirstOffset != 0 || stats.LastOffset != 3 || stats.Types[0] != 4 {
+		t.Fatalf("expect 4 messages 0-3 but got %+v", stats)
+	}
+	stat, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != stat.Size() {
+		t.Fatalf("expect size %d but got %d", stat.Size(), stats.Size)
+	}
+}
+
+func TestSegmentStatsEncrypted(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, codec := range []Codec{CodecNone, CodecZstd} {
+		path := newTestPath(t)
+		w := newTestWriterOptions(t, path, WriterOptions{
+			Codec:       codec,
+			BatchSize:   100,
+			Cipher:      CipherAESGCM,
+			KeyProvider: testKeys("k1"),
+		})
+		for i := 0; i < 10; i++ {
+			if err := w.Append(&Message{Timestamp: start.Add(time.Duration(i) * time.Second), Value: []byte(strconv.Itoa(i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		closeTestWriter(t, w)
+
+		// the last file has no meta file and is read without a key
+		dir, err := OpenJournalDir(JournalDirPath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := dir.Last().Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Count != 10 || stats.FirstOffset != 0 || stats.LastOffset != 9 || !stats.MaxTimestamp.Equal(start.Add(9*time.Second)) {
+			t.Fatalf("codec %d: expect 10 messages 0-9 but got %+v", codec, stats)
+		}
+	}
+}
+
+func TestSegmentStatsCompact(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path, 1)
+	for _, msg := range []Message{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("2")},
+		{Key: []byte("b"), Value: []byte("1")},
+	} {
+		if err := w.Append(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestWriter(t, w)
+	if _, err := NewCompactor(path).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	first := journalFileName(JournalDirPath(path), 0)
+	stats, err := (&JournalFile{FileName: first}).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := buildStats(first, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 0 || !reflect.DeepEqual(stats, built) {
+		t.Fatalf("expect stats %+v of the compacted segment but got %+v", built, stats)
+	}
+}
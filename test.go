@@ -1,6 +1,7 @@
 package sej
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -19,8 +20,12 @@ type Test struct {
 	testing.TB
 }
 
-// testDirPrefix is the prefix of test directories
-const testDirPrefix = "sej-test-"
+const (
+	// testDirPrefix is the prefix of test directories
+	testDirPrefix = "sej-test-"
+	// testWriterID is the writer ID of test writers, making the header size predictable
+	testWriterID = "test"
+)
 
 // Main should be called to clear test directories
 func (Test) Main(m *testing.M) {
@@ -65,16 +70,30 @@ func writeTestMessages(t testing.TB, w *Writer, messages ...string) {
 }
 
 func newTestWriter(t testing.TB, dir string, segmentSize ...int) *Writer {
-	w, err := NewWriter(dir)
+	var opts WriterOptions
+	if len(segmentSize) == 1 {
+		opts.SegmentSize = segmentSize[0]
+	}
+	return newTestWriterOptions(t, dir, opts)
+}
+
+func newTestWriterOptions(t testing.TB, dir string, opts WriterOptions) *Writer {
+	opts.WriterID = testWriterID
+	w, err := NewWriterOptions(dir, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(segmentSize) == 1 {
-		w.SegmentSize = segmentSize[0]
-	}
 	return w
 }
 
+func newTestScanner(t testing.TB, dir string, offset uint64, opts ScannerOptions) *Scanner {
+	s, err := NewScannerOptions(context.Background(), dir, offset, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
 func closeTestWriter(t testing.TB, w *Writer) {
 	if err := w.Close(); err != nil {
 		t.Fatal(err)
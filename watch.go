@@ -3,7 +3,7 @@ package sej
 import (
 	"io"
 	"os"
-	"sync"
+	"path/filepath"
 
 	"gopkg.in/fsnotify.v1"
 	"h12.io/sej/internal/reader"
@@ -12,9 +12,10 @@ import (
 type watchedJournalDir struct {
 	dir     *JournalDir
 	watcher *changeWatcher
+	local   *localJournal
 }
 
-func openWatchedJournalDir(dir string) (*watchedJournalDir, error) {
+func openWatchedJournalDir(dir string, detection ChangeDetection) (*watchedJournalDir, error) {
 	dirFile, err := openOrCreateDir(dir)
 	if err != nil {
 		return nil, err
@@ -22,7 +23,7 @@ func openWatchedJournalDir(dir string) (*watchedJournalDir, error) {
 	if err := dirFile.Close(); err != nil {
 		return nil, err
 	}
-	watcher, err := newChangeWatcher(dir, fsnotify.Create|fsnotify.Remove)
+	watcher, err := openChangeWatcher(dir, fsnotify.Create|fsnotify.Remove, detection)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +35,7 @@ func openWatchedJournalDir(dir string) (*watchedJournalDir, error) {
 	return &watchedJournalDir{
 		dir:     journalDir,
 		watcher: watcher,
+		local:   localJournals.acquire(dir),
 	}, nil
 }
 
@@ -41,14 +43,30 @@ func (d *watchedJournalDir) Watch() chan bool {
 	return d.watcher.Watch()
 }
 
+// WatchLocal returns a channel closed when the writer in the same process
+// appends or flushes
+func (d *watchedJournalDir) WatchLocal() <-chan struct{} {
+	return d.local.Watch()
+}
+
+// LocalWriter returns the live writer in the same process or nil
+func (d *watchedJournalDir) LocalWriter() *Writer {
+	return d.local.Writer()
+}
+
 func (d *watchedJournalDir) Find(offset uint64) (*JournalFile, error) {
-	if err := d.watcher.Err(); err != nil {
+	if err := d.reload(); err != nil {
 		return nil, err
 	}
+	return d.dir.find(offset)
+}
+
+// Files returns the up-to-date journal files
+func (d *watchedJournalDir) Files() (JournalFiles, error) {
 	if err := d.reload(); err != nil {
 		return nil, err
 	}
-	return d.dir.find(offset)
+	return d.dir.Files, nil
 }
 
 func (d *watchedJournalDir) IsLast(f *JournalFile) bool {
@@ -68,29 +86,32 @@ func (d *watchedJournalDir) reload() error {
 }
 
 func (d *watchedJournalDir) Close() error {
+	localJournals.release(d.local)
 	return d.watcher.Close()
 }
 
 // watchedFile is a io.SeekReader and reopens the underlying file
 // whenever reading to an io.EOF
 type watchedFile struct {
-	file    *fileReader
-	watcher *changeWatcher
+	file       *fileReader
+	watcher    *changeWatcher
+	bufferSize int
 }
 
-func openWatchedFile(name string) (*watchedFile, error) {
-	watcher, err := newChangeWatcher(name, fsnotify.Write)
+func openWatchedFile(name string, detection ChangeDetection, bufferSize int) (*watchedFile, error) {
+	watcher, err := openChangeWatcher(name, fsnotify.Write, detection)
 	if err != nil {
 		return nil, err
 	}
-	file, err := openFileReader(name)
+	file, err := openFileReader(name, bufferSize)
 	if err != nil {
 		watcher.Close()
 		return nil, err
 	}
 	return &watchedFile{
-		file:    file,
-		watcher: watcher,
+		file:       file,
+		watcher:    watcher,
+		bufferSize: bufferSize,
 	}, nil
 }
 
@@ -105,9 +126,6 @@ func (f *watchedFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *watchedFile) Read(p []byte) (n int, err error) {
-	if err := f.watcher.Err(); err != nil {
-		return 0, err
-	}
 	n, err = f.file.Read(p)
 	if err == io.EOF {
 		if err := f.reopen(); err != nil {
@@ -117,12 +135,16 @@ func (f *watchedFile) Read(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+func (f *watchedFile) skip(n int) (int, error) {
+	return f.file.skip(n)
+}
+
 func (f *watchedFile) reopen() error {
 	oldOffset, err := f.file.Seek(0, os.SEEK_CUR)
 	if err != nil {
 		return err
 	}
-	newFile, err := openFileReader(f.file.Name())
+	newFile, err := openFileReader(f.file.Name(), f.bufferSize)
 	if err != nil {
 		return err
 	}
@@ -157,39 +179,65 @@ func (f *watchedFile) Close() error {
 	return err2
 }
 
-// changeWatcher compresses multiple change messages into one
+// ChangeDetection is the strategy of a scanner detecting the changes of the
+// journal files
+type ChangeDetection int
+
+const (
+	// DetectAuto uses inotify and falls back to polling if inotify is unavailable
+	DetectAuto ChangeDetection = iota
+	// DetectNotify uses inotify only
+	DetectNotify
+	// DetectPoll checks the journal files every poll interval, e.g. on network
+	// file systems where inotify events never arrive
+	DetectPoll
+	// DetectHybrid uses inotify and also checks the journal files every poll
+	// interval in case any event is lost
+	DetectHybrid
+)
+
+// openChangeWatcher creates a change watcher according to the change detection
+// strategy. It returns nil if the changes are detected by polling only.
+func openChangeWatcher(name string, op fsnotify.Op, detection ChangeDetection) (*changeWatcher, error) {
+	switch detection {
+	case DetectPoll:
+		return nil, nil
+	case DetectAuto:
+		w, err := newChangeWatcher(name, op)
+		if err != nil {
+			// fall back to polling
+			return nil, nil
+		}
+		return w, nil
+	}
+	return newChangeWatcher(name, op)
+}
+
+// changeWatcher compresses multiple change messages into one.
+// A nil changeWatcher never receives any change.
 type changeWatcher struct {
-	watcher   *fsnotify.Watcher
+	name      string
 	watchedOp fsnotify.Op
 	changedCh chan bool
-	wg        sync.WaitGroup
-
-	err error
-	mu  sync.RWMutex
 }
 
 func newChangeWatcher(name string, op fsnotify.Op) (*changeWatcher, error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
-	}
-	if err := watcher.Add(name); err != nil {
-		watcher.Close()
-		return nil, err
-	}
 	w := &changeWatcher{
-		watcher:   watcher,
+		name:      filepath.Clean(name),
 		watchedOp: op,
 		changedCh: make(chan bool, 1), // make sure at least one message can be received when needed
 	}
-	w.wg.Add(2)
-	go w.watchEvent()
-	go w.watchError()
+	if err := defaultWatchMux.add(w); err != nil {
+		return nil, err
+	}
 	return w, nil
 }
 
 // Watch returns an empty channel for receiving a single event after the method is called
 func (w *changeWatcher) Watch() chan bool {
+	if w == nil {
+		return nil
+	}
 clearChan: // clear possible last events from the channel
 	for {
 		select {
@@ -201,38 +249,25 @@ clearChan: // clear possible last events from the channel
 	return w.changedCh
 }
 
-func (w *changeWatcher) watchEvent() {
-	defer w.wg.Done()
-	for event := range w.watcher.Events {
-		if event.Op&w.watchedOp > 0 {
-			select {
-			case w.changedCh <- true: // send at least one
-			default: // or skip the rest
-			}
-		}
+func (w *changeWatcher) notify(event fsnotify.Event) {
+	if event.Op&w.watchedOp > 0 {
+		w.wake()
 	}
 }
 
-func (w *changeWatcher) watchError() {
-	defer w.wg.Done()
-	for err := range w.watcher.Errors {
-		w.mu.Lock()
-		w.err = err
-		w.mu.Unlock()
+// wake sends a change to the receiver of the channel returned by Watch
+func (w *changeWatcher) wake() {
+	select {
+	case w.changedCh <- true: // send at least one
+	default: // or skip the rest
 	}
 }
 
-func (w *changeWatcher) Err() error {
-	w.mu.RLock()
-	err := w.err
-	w.mu.RUnlock()
-	return err
-}
-
 func (w *changeWatcher) Close() error {
-	w.watcher.Close()
-	w.wg.Wait()
-	return nil
+	if w == nil {
+		return nil
+	}
+	return defaultWatchMux.remove(w)
 }
 
 type fileReader struct {
@@ -240,13 +275,13 @@ type fileReader struct {
 	f *os.File
 }
 
-func openFileReader(filename string) (*fileReader, error) {
+func openFileReader(filename string, bufferSize int) (*fileReader, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	return &fileReader{
-		Reader: reader.NewReaderSize(f, 65536),
+		Reader: reader.NewReaderSize(f, bufferSize),
 		f:      f,
 	}, nil
 }
@@ -255,6 +290,36 @@ func (f *fileReader) Name() string {
 	return f.f.Name()
 }
 
+// skip seeks n bytes forward, within the buffer if possible, or within the
+// current size of the file
+func (f *fileReader) skip(n int) (int, error) {
+	if n <= f.Buffered() {
+		_, err := f.Seek(int64(n), io.SeekCurrent)
+		return n, err
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if rest := stat.Size() - pos; int64(n) > rest {
+		if rest <= 0 {
+			return 0, io.EOF
+		}
+		if _, err := f.Seek(rest, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		return int(rest), io.ErrUnexpectedEOF
+	}
+	if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (f *fileReader) Close() error {
 	return f.f.Close()
 }
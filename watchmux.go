@@ -0,0 +1,112 @@
+package sej
+
+import (
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// defaultWatchMux is shared by all the scanners of the process, so that only
+// one inotify instance is used no matter how many journals are watched
+var defaultWatchMux = &watchMux{}
+
+// watchMux fans out the events of one fsnotify watcher to the change watchers
+// subscribing to the watched files and directories
+type watchMux struct {
+	watcher *fsnotify.Watcher
+	subs    map[string]map[*changeWatcher]struct{}
+	mu      sync.Mutex
+}
+
+// add subscribes w to the changes of w.name, the name is watched by the
+// underlying watcher until all the subscribers of it are removed
+func (m *watchMux) add(w *changeWatcher) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		m.watcher = watcher
+		m.subs = make(map[string]map[*changeWatcher]struct{})
+		go m.dispatchEvents(watcher)
+		go m.dispatchErrors(watcher)
+	}
+	// added even if already watched, in case the watch has been dropped
+	// because the file was removed and then created again
+	if err := m.watcher.Add(w.name); err != nil {
+		return err
+	}
+	subs := m.subs[w.name]
+	if subs == nil {
+		subs = make(map[*changeWatcher]struct{})
+		m.subs[w.name] = subs
+	}
+	subs[w] = struct{}{}
+	return nil
+}
+
+// remove unsubscribes w and closes the underlying watcher when there are no
+// subscribers anymore
+func (m *watchMux) remove(w *changeWatcher) error {
+	m.mu.Lock()
+	subs := m.subs[w.name]
+	if _, ok := subs[w]; !ok {
+		m.mu.Unlock()
+		return nil
+	}
+	delete(subs, w)
+	if len(subs) > 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	delete(m.subs, w.name)
+	watcher := m.watcher
+	if len(m.subs) > 0 {
+		// the name may have been removed from the file system already
+		watcher.Remove(w.name)
+		m.mu.Unlock()
+		return nil
+	}
+	m.watcher, m.subs = nil, nil
+	m.mu.Unlock()
+	// closed without holding the lock because it waits for the pending
+	// events to be dispatched
+	return watcher.Close()
+}
+
+func (m *watchMux) dispatchEvents(watcher *fsnotify.Watcher) {
+	for event := range watcher.Events {
+		name := filepath.Clean(event.Name)
+		m.mu.Lock()
+		if m.watcher == watcher {
+			// the event of a file is also an event of its directory
+			for _, subName := range []string{name, filepath.Dir(name)} {
+				for w := range m.subs[subName] {
+					w.notify(event)
+				}
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// dispatchErrors wakes up all the subscribers on an error of the watcher, e.g.
+// the overflow of the inotify queue, so that they check for the changes whose
+// events may have been lost. The errors are not returned to the subscribers
+// because the watcher keeps working after them.
+func (m *watchMux) dispatchErrors(watcher *fsnotify.Watcher) {
+	for range watcher.Errors {
+		m.mu.Lock()
+		if m.watcher == watcher {
+			for _, subs := range m.subs {
+				for w := range subs {
+					w.wake()
+				}
+			}
+		}
+		m.mu.Unlock()
+	}
+}
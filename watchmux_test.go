@@ -0,0 +1,128 @@
+package sej
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+func TestWatchMuxShared(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+
+	var scanners []*Scanner
+	for i := 0; i < 3; i++ {
+		scanners = append(scanners, newTestScanner(t, path, 0, ScannerOptions{}))
+	}
+	dir, file := JournalDirPath(path), journalFileName(JournalDirPath(path), 0)
+	if n := watchMuxSubs(dir); n != 3 {
+		t.Fatalf("expect 3 subscribers of the directory but got %d", n)
+	}
+	if n := watchMuxSubs(file); n != 3 {
+		t.Fatalf("expect 3 subscribers of the file but got %d", n)
+	}
+
+	writeTestMessages(t, w, "a")
+	flushTestWriter(t, w)
+	for _, s := range scanners {
+		if !s.Scan() {
+			t.Fatal(s.Err())
+		}
+		if msg := string(s.Message().Value); msg != "a" {
+			t.Fatalf("expect a but got %s", msg)
+		}
+		s.Close()
+	}
+	if watchMuxSubs(dir) != 0 || watchMuxSubs(file) != 0 {
+		t.Fatal("expect no subscribers after all the scanners are closed")
+	}
+}
+
+func TestWatchMuxError(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+	var scanners []*Scanner
+	for i := 0; i < 2; i++ {
+		s := newTestScanner(t, path, 0, ScannerOptions{ChangeDetection: DetectNotify})
+		defer s.Close()
+		scanners = append(scanners, s)
+	}
+	dir := JournalDirPath(path)
+	watcher, err := newChangeWatcher(dir, fsnotify.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	changed := watcher.Watch()
+
+	// events may have been lost, all the subscribers check for changes
+	defaultWatchMux.mu.Lock()
+	errors := defaultWatchMux.watcher.Errors
+	defaultWatchMux.mu.Unlock()
+	errors <- fsnotify.ErrEventOverflow
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect subscribers woken up by the error")
+	}
+
+	writeTestMessages(t, w, "a")
+	flushTestWriter(t, w)
+	for _, s := range scanners {
+		if !s.Scan() {
+			t.Fatal(s.Err())
+		}
+		if msg := string(s.Message().Value); msg != "a" {
+			t.Fatalf("expect a but got %s", msg)
+		}
+	}
+}
+
+func watchMuxSubs(name string) int {
+	defaultWatchMux.mu.Lock()
+	defer defaultWatchMux.mu.Unlock()
+	return len(defaultWatchMux.subs[name])
+}
+
+func TestScanPolling(t *testing.T) {
+	DefaultChangeDetection = DetectPoll
+	defer func() { DefaultChangeDetection = DetectAuto }()
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "a")
+	closeTestWriter(t, w)
+
+	s := newTestScanner(t, path, 1, ScannerOptions{Timeout: 5 * time.Second, PollInterval: 10 * time.Millisecond})
+	defer s.Close()
+	dir, file := JournalDirPath(path), journalFileName(JournalDirPath(path), 0)
+	if watchMuxSubs(dir) != 0 || watchMuxSubs(file) != 0 {
+		t.Fatal("expect no inotify watch when polling")
+	}
+
+	// appended by another process without any notification
+	time.AfterFunc(10*time.Millisecond, func() {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		if _, err := WriteMessage(f, make([]byte, 8), &Message{Offset: 1, Value: []byte("b")}); err != nil {
+			t.Error(err)
+		}
+	})
+	start := time.Now()
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if msg := string(s.Message().Value); msg != "b" {
+		t.Fatalf("expect b but got %s", msg)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect polled immediately but took %v", elapsed)
+	}
+}
@@ -2,33 +2,69 @@ package sej
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"errors"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Writer writes to segmented journal files
 type Writer struct {
 	dir     string
 	dirLock *fileLock
+	local   *localJournal
 	offset  uint64
 
 	w       *bufio.Writer
+	crcw    crcWriter // calculates the checksum of the current file under w
 	file    *os.File
 	fileLen int
+	fileOff uint64       // the first offset of the current file
+	created time.Time    // the creation time of the current file
+	fileMu  sync.RWMutex // held when syncing the file without holding mu
+	index   *indexWriter
+	stats   *SegmentStats // of the current file, nil if appended by a previous writer
 
-	err    error
-	msgBuf []byte
-	mu     sync.Mutex
+	commit   *groupCommit
+	unsynced int
+	syncStop chan struct{}
+	syncDone chan struct{}
 
-	SegmentSize int
+	asyncMu      sync.Mutex
+	asyncClosed  bool
+	queue        chan *AppendResult
+	asyncDrained chan struct{}
+	asyncDone    chan struct{}
+
+	err     error
+	msgBuf  []byte
+	batch   bytes.Buffer
+	pending batchWriter // messages to be compressed with Codec
+	linger  *time.Timer
+	aead    cipher.AEAD // encrypts the messages of the current file, nil if not encrypted
+	mu      sync.Mutex
+
+	opts WriterOptions
 }
 
-// NewWriter creates a new writer for writing to dir/jnl with file size at least segmentSize
+// NewWriter creates a new writer for writing to dir/jnl with the default options
 func NewWriter(dir string) (*Writer, error) {
+	return NewWriterOptions(dir, WriterOptions{})
+}
+
+// NewWriterOptions creates a new writer for writing to dir/jnl with opts,
+// returning an OptionError if any option is invalid
+func NewWriterOptions(dir string, opts WriterOptions) (*Writer, error) {
+	opts, err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
 	os.MkdirAll(dir, 0755)
 	dir = JournalDirPath(dir)
 	dirLock, err := openFileLock(dir + ".lck")
@@ -41,6 +77,12 @@ func NewWriter(dir string) (*Writer, error) {
 		return nil, err
 	}
 	journalFile := names.Last()
+	// the header of the last file is checked before appending to it, while the
+	// other files are checked when they are read
+	if err := journalFile.checkHeader(); err != nil {
+		dirLock.Close()
+		return nil, err
+	}
 	file, err := openOrCreate(journalFile.FileName)
 	if err != nil {
 		dirLock.Close()
@@ -69,25 +111,99 @@ func NewWriter(dir string) (*Writer, error) {
 			FixErr:    fixErr,
 		}
 	}
+	created := time.Now().UTC()
+	header, err := journalFile.Header()
+	if err == nil && header != nil {
+		created = header.Created
+	}
+	// the messages are appended with the cipher and key of the last file, unless
+	// its cipher is not the configured one
+	var aead cipher.AEAD
+	reencrypt := false
+	fileLen := int(stat.Size())
+	if fileLen > 0 {
+		fileCipher := CipherNone
+		if header != nil {
+			fileCipher = header.Cipher
+		}
+		if fileCipher != opts.Cipher {
+			if latestOffset == journalFile.FirstOffset {
+				// no messages yet, rewrite the header
+				if err := file.Truncate(0); err != nil {
+					dirLock.Close()
+					file.Close()
+					return nil, err
+				}
+				fileLen = 0
+			} else {
+				reencrypt = true
+			}
+		} else if aead, err = segmentAEAD(header, opts.KeyProvider); err != nil {
+			dirLock.Close()
+			file.Close()
+			return nil, err
+		}
+	}
 	if _, err := file.Seek(0, os.SEEK_END); err != nil {
 		dirLock.Close()
 		file.Close()
 		return nil, err
 	}
-	return &Writer{
-		dir:         dir,
-		dirLock:     dirLock,
-		file:        file,
-		offset:      latestOffset,
-		fileLen:     int(stat.Size()),
-		w:           newBufferWriter(file),
-		msgBuf:      make([]byte, 8),
-		SegmentSize: 1024 * 1024 * 1024,
-	}, nil
+	// the meta file is written again when the last file is sealed
+	if err := os.Remove(metaFileName(journalFile.FileName)); err != nil && !os.IsNotExist(err) {
+		dirLock.Close()
+		file.Close()
+		return nil, err
+	}
+	index, err := openIndexWriter(journalFile.FileName, opts.IndexInterval)
+	if err != nil {
+		dirLock.Close()
+		file.Close()
+		return nil, err
+	}
+	w := &Writer{
+		dir:     dir,
+		dirLock: dirLock,
+		local:   localJournals.acquire(dir),
+		file:    file,
+		offset:  latestOffset,
+		fileLen: fileLen,
+		fileOff: journalFile.FirstOffset,
+		created: created,
+		index:   index,
+		commit:  newGroupCommit(latestOffset),
+		crcw:    crcWriter{w: file},
+		msgBuf:  make([]byte, 8),
+		aead:    aead,
+		opts:    opts,
+	}
+	w.w = bufio.NewWriterSize(&w.crcw, opts.BufferSize)
+	if fileLen == 0 {
+		w.stats = &SegmentStats{}
+	}
+	if reencrypt {
+		// continue in a new file with the configured cipher
+		if err := w.roll(); err != nil {
+			dirLock.Close()
+			w.file.Close()
+			localJournals.release(w.local)
+			return nil, err
+		}
+	}
+	w.local.setWriter(w)
+	return w, nil
 }
 
 // Append appends a message to the journal
+// With SyncGroupCommit durability, it returns after the message is synced.
 func (w *Writer) Append(msg *Message) error {
+	if err := w.append(msg); err != nil {
+		return err
+	}
+	return w.waitDurable(msg.Offset + 1)
+}
+
+func (w *Writer) append(msg *Message) error {
 	w.mu.Lock()
 	// slow but correct: wait for https://github.com/golang/go/issues/14939
 	defer w.mu.Unlock()
@@ -95,35 +211,294 @@ func (w *Writer) Append(msg *Message) error {
 	if w.err != nil { // skip if an error already happens
 		return w.err
 	}
-	if len(msg.Key) > math.MaxInt8 {
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	if err := w.rollExpired(time.Now()); err != nil {
+		w.err = err
+		return err
+	}
+	if err := w.appendTo(w.w, msg); err != nil {
+		w.err = err
+		return err
+	}
+	if w.fileLen >= w.opts.SegmentSize {
+		if err := w.roll(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	if err := w.afterAppend(); err != nil {
+		w.err = err
+		return err
+	}
+	w.local.Broadcast()
+	return nil
+}
+
+// AppendBatch appends messages with contiguous offsets to the journal and
+// returns the offset of the first message.
+// The messages are encoded into one buffer and written with the lock acquired
+// only once. Either all or none of the messages are appended unless an I/O
+// error occurs.
+// With SyncGroupCommit durability, it returns after the messages are synced.
+func (w *Writer) AppendBatch(msgs []Message) (uint64, error) {
+	first, err := w.appendBatch(msgs)
+	if err != nil {
+		return first, err
+	}
+	return first, w.waitDurable(first + uint64(len(msgs)))
+}
+
+func (w *Writer) appendBatch(msgs []Message) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.offset, w.err
+	}
+	for i := range msgs {
+		if err := checkMessage(&msgs[i]); err != nil {
+			return w.offset, err
+		}
+	}
+	if err := w.rollExpired(time.Now()); err != nil {
+		w.err = err
+		return w.offset, err
+	}
+	first := w.offset
+	w.batch.Reset()
+	for i := range msgs {
+		if err := w.appendTo(&w.batch, &msgs[i]); err != nil {
+			w.err = err
+			return first, err
+		}
+		if w.fileLen >= w.opts.SegmentSize {
+			if err := w.writeBatch(); err != nil {
+				w.err = err
+				return first, err
+			}
+			if err := w.roll(); err != nil {
+				w.err = err
+				return first, err
+			}
+		}
+	}
+	if err := w.writeBatch(); err != nil {
+		w.err = err
+		return first, err
+	}
+	if err := w.afterAppend(); err != nil {
+		w.err = err
+		return first, err
+	}
+	w.local.Broadcast()
+	return first, nil
+}
+
+func checkMessage(msg *Message) error {
+	if len(msg.Key) > math.MaxInt32 {
 		return errors.New("key is too long")
 	}
 	if len(msg.Value) > math.MaxInt32 {
 		return errors.New("value is too long")
 	}
+	if len(msg.Headers) > math.MaxUint16 {
+		return errors.New("too many headers")
+	}
+	for i := range msg.Headers {
+		if len(msg.Headers[i].Name) > math.MaxUint8 {
+			return errors.New("header name is too long")
+		}
+		if len(msg.Headers[i].Value) > math.MaxInt32 {
+			return errors.New("header value is too long")
+		}
+	}
+	return nil
+}
+
+// appendTo writes the message (and the segment header if needed) to dst,
+// which is either the buffer writer of the current file or the batch buffer
+func (w *Writer) appendTo(dst io.Writer, msg *Message) error {
+	if w.fileLen == 0 {
+		if err := w.writeHeader(dst); err != nil {
+			return err
+		}
+	}
 	msg.Offset = w.offset
-	numWritten, err := WriteMessage(w.w, w.msgBuf, msg)
+	if w.stats != nil {
+		w.stats.add(msg)
+	}
+	if w.opts.Codec != CodecNone || w.aead != nil {
+		return w.addPending(dst, msg)
+	}
+	pos := w.fileLen
+	numWritten, err := WriteMessage(dst, w.msgBuf, msg)
 	w.fileLen += int(numWritten)
+	w.unsynced += int(numWritten)
 	if err != nil {
-		w.err = err
+		return err
+	}
+	if err := w.index.Add(msg, int64(pos), w.opts.IndexInterval); err != nil {
 		return err
 	}
 	w.offset++
-	if w.fileLen >= w.SegmentSize {
-		if err := w.closeFile(); err != nil {
-			w.err = err
+	return nil
+}
+
+// addPending adds the message to the pending batch, which is compressed and
+// written to dst when it reaches BatchSize. Without compression, the message
+// is encrypted and written as a batch on its own.
+func (w *Writer) addPending(dst io.Writer, msg *Message) error {
+	if err := w.pending.add(msg, w.msgBuf); err != nil {
+		return err
+	}
+	w.offset++
+	if w.pending.buf.Len() >= w.opts.BatchSize || w.opts.Codec == CodecNone {
+		return w.writePending(dst)
+	}
+	if w.pending.count == 1 && w.opts.BatchLinger > 0 {
+		first := msg.Offset
+		w.linger = time.AfterFunc(w.opts.BatchLinger, func() { w.lingerExpired(first) })
+	}
+	return nil
+}
+
+// writePending compresses and encrypts the pending messages if any and writes
+// them as a batch to dst
+func (w *Writer) writePending(dst io.Writer) error {
+	if w.pending.count == 0 {
+		return nil
+	}
+	first, timestamp := w.pending.offset, w.pending.timestamp
+	pos := w.fileLen
+	numWritten, err := w.pending.writeTo(dst, w.msgBuf, w.opts.Codec, w.aead)
+	w.fileLen += int(numWritten)
+	w.unsynced += int(numWritten)
+	if err != nil {
+		return err
+	}
+	// the batch is indexed like its first message with the maximal timestamp
+	return w.index.Add(&Message{Offset: first, Timestamp: timestamp}, int64(pos), w.opts.IndexInterval)
+}
+
+// lingerExpired writes and flushes the pending batch if it still starts from
+// first after BatchLinger
+func (w *Writer) lingerExpired(first uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil || w.pending.count == 0 || w.pending.offset != first {
+		return
+	}
+	if err := w.flush(); err != nil {
+		w.err = err
+		return
+	}
+	w.local.Broadcast()
+}
+
+// flush writes the pending batch and flushes the buffer to the current file
+func (w *Writer) flush() error {
+	if err := w.writePending(w.w); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// writeBatch writes the encoded messages in the batch buffer to the current file
+func (w *Writer) writeBatch() error {
+	_, err := w.w.Write(w.batch.Bytes())
+	w.batch.Reset()
+	return err
+}
+
+// roll closes and seals the current file and creates a new one starting from
+// the current offset
+func (w *Writer) roll() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if err := w.seal(); err != nil {
+		return err
+	}
+	var err error
+	w.file, err = openOrCreate(journalFileName(w.dir, w.offset))
+	if err != nil {
+		return err
+	}
+	w.index, err = createIndexWriter(w.file.Name())
+	if err != nil {
+		return err
+	}
+	w.fileLen = 0
+	w.fileOff = w.offset
+	w.stats = &SegmentStats{}
+	w.crcw = crcWriter{w: w.file}
+	w.w = bufio.NewWriterSize(&w.crcw, w.opts.BufferSize)
+	return w.writeHeader(w.w)
+}
+
+// seal writes the meta file of the closed current file, with the stats
+// collected while appending, or read from the file if it was appended by a
+// previous writer. The meta file is skipped if the file cannot be decrypted.
+func (w *Writer) seal() error {
+	name := w.file.Name()
+	stats := w.stats
+	if stats != nil {
+		stats.Size = int64(w.fileLen)
+		stats.Checksum = w.crcw.crc
+	} else {
+		var err error
+		if stats, err = buildStats(name, w.opts.KeyProvider); err == ErrNoKey {
+			return nil
+		} else if err != nil {
 			return err
 		}
-		var err error
-		w.file, err = openOrCreate(journalFileName(w.dir, w.offset))
+	}
+	return writeMeta(name, stats)
+}
+
+// rollExpired rolls the current file if it contains messages and is older
+// than SegmentMaxAge at now
+func (w *Writer) rollExpired(now time.Time) error {
+	if w.opts.SegmentMaxAge <= 0 || w.offset == w.fileOff {
+		return nil
+	}
+	deadline := w.created.Add(w.opts.SegmentMaxAge)
+	if w.opts.SegmentAligned {
+		deadline = w.created.Truncate(w.opts.SegmentMaxAge).Add(w.opts.SegmentMaxAge)
+	}
+	if now.Before(deadline) {
+		return nil
+	}
+	return w.roll()
+}
+
+// writeHeader writes the segment header of an empty segment file to dst. The
+// messages of the file are encrypted with the current key of KeyProvider if
+// Cipher is configured.
+func (w *Writer) writeHeader(dst io.Writer) error {
+	h := SegmentHeader{
+		Version:  segmentVersion,
+		Created:  time.Now().UTC(),
+		WriterID: w.opts.WriterID,
+		Cipher:   w.opts.Cipher,
+	}
+	w.aead = nil
+	if w.opts.Cipher != CipherNone {
+		keyID, key, err := w.opts.KeyProvider.CurrentKey()
 		if err != nil {
-			w.err = err
 			return err
 		}
-		w.fileLen = 0
-		w.w = newBufferWriter(w.file)
+		if w.aead, err = newAEAD(w.opts.Cipher, key); err != nil {
+			return err
+		}
+		h.KeyID = keyID
 	}
-	return nil
+	n, err := h.WriteTo(dst)
+	w.fileLen += int(n)
+	w.created = h.Created
+	return err
 }
 
 // Offset returns the latest offset of the journal
@@ -137,7 +512,16 @@ func (w *Writer) Offset() uint64 {
 func (w *Writer) Flush() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.w.Flush()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.local.Broadcast()
+	// the index is flushed after the journal so that its entries never point
+	// beyond the flushed messages
+	return w.index.Flush()
 }
 
 // Sync calls File.Sync of the current file
@@ -149,52 +533,98 @@ func (w *Writer) Sync() error {
 
 // Close closes the writer, flushes the buffer and syncs the file to the hard drive
 func (w *Writer) Close() error {
+	asyncDone := w.stopAsync()
+	w.stopSyncing()
 	w.mu.Lock()
-	defer w.mu.Unlock()
-	if err := w.closeFile(); err != nil {
+	if w.linger != nil {
+		w.linger.Stop()
+	}
+	err := w.closeFile()
+	w.commit.close()
+	w.mu.Unlock()
+	w.local.setWriter(nil)
+	w.local.Broadcast()
+	localJournals.release(w.local)
+	if asyncDone != nil {
+		<-asyncDone
+	}
+	if err != nil {
 		return err
 	}
 	return w.dirLock.Close()
 }
 
 func (w *Writer) closeFile() error {
-	if err := w.w.Flush(); err != nil {
+	if err := w.flush(); err != nil {
 		return err
 	}
 	if err := w.file.Sync(); err != nil {
 		return err
 	}
-	if err := w.file.Close(); err != nil {
+	w.unsynced = 0
+	w.commit.markSynced(w.offset)
+	w.fileMu.Lock()
+	err := w.file.Close()
+	w.fileMu.Unlock()
+	if err != nil {
 		return err
 	}
-	return nil
+	return w.index.Close()
 }
 
 func openOrCreate(file string) (*os.File, error) {
 	return os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
 }
 
-func newBufferWriter(w io.Writer) *bufio.Writer {
-	return bufio.NewWriterSize(w, 4096)
+func defaultWriterID() string {
+	hostname, _ := os.Hostname()
+	return hostname + ":" + strconv.Itoa(os.Getpid())
 }
 
+// truncateCorruption truncates the torn tail of the journal file after the
+// last complete message, or returns errCorruptionNotAtTail if a corrupted
+// message is followed by other data, so that it is not silently dropped
 func truncateCorruption(file string) (bad []byte, lastMessage *Message, err error) {
 	f, err := os.OpenFile(file, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, &Message{}, err
 	}
 	defer f.Close()
+	// the messages are read as records, so that the key is not needed
+	cr := crcReader{r: f}
 	var msg Message
 	var lastMsg Message
+	if _, err := ReadSegmentHeader(f); err != nil {
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF, errSegmentHeaderCorrupted:
+			// the header is incomplete, truncate the whole file
+			truncatedHeader, err := ioutil.ReadAll(f)
+			if err != nil {
+				return nil, &lastMsg, err
+			}
+			if err := f.Truncate(0); err != nil {
+				return nil, &lastMsg, err
+			}
+			return truncatedHeader, &lastMsg, nil
+		default:
+			return nil, &lastMsg, err
+		}
+	}
 	for {
-		n, err := msg.ReadFrom(f)
+		n, last, err := cr.readRecord(&msg)
 		if err != nil {
 			switch err {
-			case io.EOF, io.ErrUnexpectedEOF, errMessageCorrupted:
+			case io.EOF, io.ErrUnexpectedEOF, errMessageCorrupted, ErrCRC:
+				readErr := err
 				offset, err := f.Seek(-n, io.SeekCurrent)
 				if err != nil {
 					return nil, &lastMsg, err
 				}
+				if torn, err := isTornTail(f, offset, n, readErr); err != nil {
+					return nil, &lastMsg, err
+				} else if !torn {
+					return nil, &lastMsg, errCorruptionNotAtTail
+				}
 				truncatedMsg, err := ioutil.ReadAll(f)
 				if err != nil {
 					return nil, &lastMsg, err
@@ -208,5 +638,39 @@ func truncateCorruption(file string) (bad []byte, lastMessage *Message, err erro
 			}
 		}
 		lastMsg = msg
+		lastMsg.Offset = last
+	}
+}
+
+// isTornTail returns true if the damaged message of n bytes read at offset
+// with readErr is the torn tail of a crash, i.e. it reaches the end of file
+// f, or it is followed only by zeros (the unwritten blocks of a file system).
+// The file position is kept at offset.
+func isTornTail(f *os.File, offset, n int64, readErr error) (bool, error) {
+	if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+		return true, nil
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if offset+n >= stat.Size() {
+		return true, nil
+	}
+	defer f.Seek(offset, io.SeekStart)
+	if _, err := f.Seek(offset+n, io.SeekStart); err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b != 0 {
+			return false, nil
+		}
 	}
 }
@@ -1,8 +1,12 @@
 package sej
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestWriteFlush(t *testing.T) {
@@ -29,18 +33,18 @@ func TestWriteSegment(t *testing.T) {
 	}{
 		{
 			messages:  []string{"a", "ab"},
-			maxSize:   0,
-			fileSizes: []int{metaSize + 1, metaSize + 2, 0},
+			maxSize:   1,
+			fileSizes: []int{headerSize + metaSize + 1, headerSize + metaSize + 2, headerSize},
 		},
 		{
 			messages:  []string{"a"},
-			maxSize:   (metaSize + 1),
-			fileSizes: []int{metaSize + 1, 0},
+			maxSize:   headerSize + (metaSize + 1),
+			fileSizes: []int{headerSize + metaSize + 1, headerSize},
 		},
 		{
 			messages:  []string{"a", "bc"},
-			maxSize:   (metaSize + 1) + (metaSize + 2),
-			fileSizes: []int{(metaSize + 1) + (metaSize + 2), 0},
+			maxSize:   headerSize + (metaSize + 1) + (metaSize + 2),
+			fileSizes: []int{headerSize + (metaSize + 1) + (metaSize + 2), headerSize},
 		},
 	} {
 		func() {
@@ -67,7 +71,7 @@ func TestWriteReopen(t *testing.T) {
 	tt := Test{t}
 	messages := []string{"a", "bc", "def"}
 	// test cases for multiple and single segments
-	for _, segmentSize := range []int{0, 50} {
+	for _, segmentSize := range []int{1, 50} {
 		func() {
 			path := newTestPath(t)
 			for _, msg := range messages {
@@ -111,3 +115,124 @@ func TestWriteDetectCorruption(t *testing.T) {
 	}
 
 }
+
+func TestWriteCorruptionNotAtTail(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	writeTestMessages(t, w, "a", "bbbbbbbb", "c")
+	closeTestWriter(t, w)
+
+	// flip a bit in the middle and tear the tail
+	file := JournalDirPath(path) + "/0000000000000000.jnl"
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("bbbbbbbb"))] ^= 1
+	if err := ioutil.WriteFile(file, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages after the corrupted one are not truncated
+	for i := 0; i < 2; i++ {
+		_, err := NewWriter(path)
+		if e, ok := err.(*CorruptionError); !ok || e.FixErr != errCorruptionNotAtTail {
+			t.Fatalf("expect corruption not at the tail but got %v", err)
+		}
+	}
+	if stat, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(len(data)-1) {
+		t.Fatalf("expect size %d but got %d", len(data)-1, stat.Size())
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	tt := Test{t}
+	messages := []string{"a", "bc", "def", "g"}
+	// test cases for multiple and single segments
+	for _, segmentSize := range []int{1, headerSize + 2*metaSize + 3, 1000} {
+		func() {
+			path := newTestPath(t)
+			w := newTestWriter(t, path, segmentSize)
+			writeTestMessages(t, w, "0")
+			batch := make([]Message, len(messages))
+			for i := range messages {
+				batch[i].Value = []byte(messages[i])
+			}
+			first, err := w.AppendBatch(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != 1 {
+				t.Fatalf("expect first offset 1 but got %d", first)
+			}
+			for i := range batch {
+				if batch[i].Offset != uint64(i+1) {
+					t.Fatalf("expect offset %d but got %d", i+1, batch[i].Offset)
+				}
+			}
+			if w.Offset() != uint64(len(messages)+1) {
+				t.Fatalf("expect offset %d but got %d", len(messages)+1, w.Offset())
+			}
+			closeTestWriter(t, w)
+			tt.VerifyMessageValues(path, append([]string{"0"}, messages...)...)
+		}()
+	}
+}
+
+func TestWriteBatchTooLong(t *testing.T) {
+	path := newTestPath(t)
+	w := newTestWriter(t, path)
+	defer closeTestWriter(t, w)
+	if _, err := w.AppendBatch([]Message{{Value: []byte("a")}, {Headers: []Header{{Name: string(make([]byte, 256))}}}}); err == nil {
+		t.Fatal("expect error but got nil")
+	}
+	if w.Offset() != 0 {
+		t.Fatalf("expect nothing appended but got offset %d", w.Offset())
+	}
+}
+
+func TestWriteSegmentMaxAge(t *testing.T) {
+	for _, testcase := range []struct {
+		aligned bool
+		created string
+		now     string
+		rolled  bool
+	}{
+		{aligned: false, created: "10:30", now: "11:29", rolled: false},
+		{aligned: false, created: "10:30", now: "11:30", rolled: true},
+		{aligned: true, created: "10:30", now: "10:59", rolled: false},
+		{aligned: true, created: "10:30", now: "11:00", rolled: true},
+	} {
+		func() {
+			path := newTestPath(t)
+			w := newTestWriterOptions(t, path, WriterOptions{SegmentMaxAge: time.Hour, SegmentAligned: testcase.aligned})
+			defer closeTestWriter(t, w)
+			writeTestMessages(t, w, "a")
+
+			w.created = parseTestClock(t, testcase.created)
+			if err := w.rollExpired(parseTestClock(t, testcase.now)); err != nil {
+				t.Fatal(err)
+			}
+			if rolled := w.fileOff == 1; rolled != testcase.rolled {
+				t.Fatalf("%v: expect rolled %v but got %v", testcase, testcase.rolled, rolled)
+			}
+			// an empty segment is never rolled
+			if err := w.rollExpired(parseTestClock(t, testcase.now).Add(24 * time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if testcase.rolled && w.fileOff != 1 {
+				t.Fatalf("expect empty segment not rolled but got %d", w.fileOff)
+			}
+		}()
+	}
+}
+
+func parseTestClock(t *testing.T, clock string) time.Time {
+	tm, err := time.Parse("2006-01-02 15:04", "2017-01-01 "+clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}